@@ -0,0 +1,40 @@
+package typesense30142
+
+import (
+	"context"
+	"math"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// CountEvents returns the number of indexed events matching the filter (NIP-45).
+// The filter is translated like in QueryEvents and only the number of hits
+// Typesense found is read, without fetching any documents. Tag filters without
+// an indexed counterpart can only be checked against the raw events, in that
+// case the matching events are fetched and counted. Counts that would read more
+// than MaxScannedHits hits fail with ErrScanLimit.
+func (ts *TSBackend) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	query, err := buildQuery(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(query.UnindexedTags) > 0 {
+		var count int64
+		err := ts.searchPages(ctx, query, math.MaxInt, nil, func(nostr.Event) bool {
+			count++
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+		return count, nil
+	}
+
+	response, err := ts.searchPage(ctx, query, 1, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(response.Found), nil
+}
@@ -0,0 +1,33 @@
+package typesense30142
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("0", r.URL.Query().Get("per_page"))
+		assert.Equal("eventKind:=[30142] && keywords:=`Sprache`", r.URL.Query().Get("filter_by"))
+		w.Write([]byte(`{"found": 1234, "hits": [], "page": 1}`))
+	}))
+	defer server.Close()
+
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	count, err := ts.CountEvents(context.Background(), nostr.Filter{
+		Kinds: []int{30142},
+		Tags:  nostr.TagMap{"keywords": []string{"Sprache"}},
+		Limit: 10,
+	})
+
+	assert.NoError(err)
+	assert.Equal(int64(1234), count)
+}
@@ -2,31 +2,158 @@ package typesense30142
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
-// Delete a nostr event from the index
+// Delete a nostr event from the index and record tombstones, so that it isn't
+// indexed again when the deleted event is rebroadcast. Only the document of this
+// very event is removed, a newer version of its address is kept. The document is
+// matched by event id, which also finds documents indexed under an older id scheme.
 func (ts *TSBackend) DeleteEvent(ctx context.Context, event *nostr.Event) error {
-	fmt.Println("deleting event")
 	d := event.Tags.GetD()
+	ts.logger().DebugContext(ctx, "deleting event", eventAttrs(event)...)
 
-	url := fmt.Sprintf(
-		"%s/collections/%s/documents?filter_by=d:=%s&&eventPubKey:=%s",
-		ts.Host, ts.CollectionName, d, event.PubKey)
-
-	resp, body, err := ts.makehttpRequest(url, http.MethodDelete, nil)
+	filterBy := (&FilterBuilder{}).Equals("eventID", event.ID)
+	deleted, err := ts.deleteByFilter(ctx, filterBy)
 	if err != nil {
 		return err
 	}
+	ts.metrics().CountEvents(EventDeleted, deleted)
 
-	// Any status code other than 200 is an error
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	if err := ts.putTombstone(ctx, eventTombstone(event.ID, event.PubKey)); err != nil {
+		return err
+	}
+
+	// All versions of the address up to this one are gone
+	if nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind) {
+		return ts.putTombstone(ctx, addressTombstone(event.Kind, event.PubKey, d, event.CreatedAt))
 	}
 
 	return nil
 }
 
+// ProcessDeletion applies a NIP-09 deletion request (kind 5) to the index and returns
+// the number of removed documents. Events referenced by "e" tags are removed by id,
+// addresses referenced by "a" tags (kind:pubkey:d) lose all versions up to the
+// created_at of the deletion request. Only events of the deletion's author are removed,
+// deletion requests without a valid signature are rejected with ErrInvalidSignature.
+// Tombstones are recorded for every reference, so deleted events aren't indexed again.
+func (ts *TSBackend) ProcessDeletion(ctx context.Context, deletion *nostr.Event) (int, error) {
+	if deletion.Kind != nostr.KindDeletion {
+		return 0, fmt.Errorf("event of kind %d is not a deletion request", deletion.Kind)
+	}
+
+	// The author check below trusts the pubkey of the deletion request
+	if ok, err := deletion.CheckSignature(); !ok {
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+		}
+		return 0, ErrInvalidSignature
+	}
+
+	var eventIDs []string
+	var addresses []*FilterBuilder
+	var tombstones []*Tombstone
+
+	for _, tag := range deletion.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		switch tag[0] {
+		case "e":
+			eventIDs = append(eventIDs, tag[1])
+			tombstones = append(tombstones, eventTombstone(tag[1], deletion.PubKey))
+		case "a":
+			kind, pubkey, d, ok := parseAddress(tag[1])
+			if !ok || pubkey != deletion.PubKey {
+				continue
+			}
+			addresses = append(addresses, (&FilterBuilder{}).
+				EqualsInt("eventKind", kind).
+				Equals("eventPubKey", pubkey).
+				Equals("d", d).
+				Compare("eventCreatedAt", "<=", int64(deletion.CreatedAt)))
+			tombstones = append(tombstones, addressTombstone(kind, pubkey, d, deletion.CreatedAt))
+		}
+	}
+
+	for _, tombstone := range tombstones {
+		if err := ts.putTombstone(ctx, tombstone); err != nil {
+			return 0, err
+		}
+	}
+
+	deleted := 0
+
+	if len(eventIDs) > 0 {
+		filterBy := (&FilterBuilder{}).Equals("eventID", eventIDs...).Equals("eventPubKey", deletion.PubKey)
+		n, err := ts.deleteByFilter(ctx, filterBy)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		ts.metrics().CountEvents(EventDeleted, n)
+	}
+
+	for _, filterBy := range addresses {
+		n, err := ts.deleteByFilter(ctx, filterBy)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		ts.metrics().CountEvents(EventDeleted, n)
+	}
+
+	return deleted, nil
+}
+
+// parseAddress splits an event address of the form kind:pubkey:d
+func parseAddress(address string) (kind int, pubkey string, d string, ok bool) {
+	parts := strings.SplitN(address, ":", 3)
+	if len(parts) != 3 {
+		return 0, "", "", false
+	}
+
+	kind, err := strconv.Atoi(parts[0])
+	if err != nil || !nostr.IsReplaceableKind(kind) && !nostr.IsAddressableKind(kind) {
+		return 0, "", "", false
+	}
+
+	if !nostr.IsValidPublicKey(parts[1]) {
+		return 0, "", "", false
+	}
+
+	return kind, parts[1], parts[2], true
+}
+
+// deleteByFilter removes all documents matching the filter and returns how many were removed
+func (ts *TSBackend) deleteByFilter(ctx context.Context, filterBy *FilterBuilder) (int, error) {
+	path := ts.documentsPath("", url.Values{"filter_by": {filterBy.String()}})
+
+	resp, body, err := ts.makehttpRequest(ctx, opDelete, path, http.MethodDelete, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// Any status code other than 200 is an error
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to delete documents: %w", newTypesenseError(resp, body))
+	}
+
+	var result struct {
+		NumDeleted int `json:"num_deleted"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return 0, fmt.Errorf("error parsing delete response: %v", err)
+	}
+
+	return result.NumDeleted, nil
+}
@@ -0,0 +1,120 @@
+package typesense30142
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessDeletion(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	fake.numDeleted = 1
+	ts := fake.backend()
+
+	sk := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(sk)
+	other, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+
+	deletion := &nostr.Event{
+		Kind:      nostr.KindDeletion,
+		CreatedAt: 1700000000,
+		Tags: nostr.Tags{
+			{"e", "id1"},
+			{"e", "id2"},
+			{"a", "30142:" + author + ":resource:with:colons"},
+			{"a", "30142:" + other + ":not-my-resource"},
+			{"a", "1:" + author + ":regular-kind"},
+			{"a", "invalid"},
+		},
+	}
+	deletion.Sign(sk)
+
+	deleted, err := ts.ProcessDeletion(context.Background(), deletion)
+
+	assert.NoError(err)
+	assert.Equal(2, deleted)
+	assert.Equal([]string{
+		"eventID:=[`id1`,`id2`] && eventPubKey:=`" + author + "`",
+		"eventKind:=[30142] && eventPubKey:=`" + author + "` && d:=`resource:with:colons` && eventCreatedAt:<=1700000000",
+	}, fake.deleteFilters)
+}
+
+func TestProcessDeletion_WrongKind(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+
+	_, err := ts.ProcessDeletion(context.Background(), createTestEvent(nostr.Tags{{"e", "id1"}}))
+
+	assert.Error(err)
+	assert.Empty(fake.deleteFilters)
+}
+
+func TestProcessDeletion_InvalidSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+
+	// A deletion request claiming to be from the author of the event
+	author, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	deletion := &nostr.Event{Kind: nostr.KindDeletion, CreatedAt: 2000, Tags: nostr.Tags{{"a", "30142:" + author + ":resource"}}}
+	deletion.Sign(nostr.GeneratePrivateKey())
+	deletion.PubKey = author
+
+	_, err := ts.ProcessDeletion(context.Background(), deletion)
+
+	assert.ErrorIs(err, ErrInvalidSignature)
+	assert.Empty(fake.deleteFilters)
+	assert.Empty(fake.collection("amb_tombstones"))
+}
+
+func TestDeleteEvent_SingleDocument(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	// Regular events without d tag of the same author
+	first := &nostr.Event{Kind: 1, CreatedAt: 1000, Content: "first"}
+	first.Sign(sk)
+	second := &nostr.Event{Kind: 1, CreatedAt: 2000, Content: "second"}
+	second.Sign(sk)
+	// Addressable events of the same author and d but different kinds
+	resource := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	resource.Sign(sk)
+	other := &nostr.Event{Kind: 30143, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	other.Sign(sk)
+
+	for _, event := range []*nostr.Event{first, second, resource, other} {
+		assert.NoError(ts.SaveEvent(ctx, event))
+	}
+
+	assert.NoError(ts.DeleteEvent(ctx, first))
+	assert.NoError(ts.DeleteEvent(ctx, resource))
+
+	documents := fake.collection("amb")
+	assert.Len(documents, 2)
+	assert.Contains(documents, documentID(second))
+	assert.Contains(documents, documentID(other))
+}
+
+func TestDeleteEvent_LegacyDocument(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+
+	event := createTestEvent(nostr.Tags{{"d", "resource"}})
+	fake.collection("amb")[event.ID] = legacyDocument(event)
+
+	assert.NoError(ts.DeleteEvent(context.Background(), event))
+	assert.Empty(fake.collection("amb"))
+}
@@ -0,0 +1,100 @@
+package typesense30142
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	// ErrNotFound matches a TypesenseError for a missing collection or document
+	ErrNotFound = errors.New("typesense resource not found")
+	// ErrUnauthorized matches a TypesenseError for a rejected API key
+	ErrUnauthorized = errors.New("typesense rejected the api key")
+	// ErrConflict matches a TypesenseError for a document or collection that already exists
+	ErrConflict = errors.New("typesense resource already exists")
+	// ErrUnavailable matches a TypesenseError for an overloaded or unavailable Typesense,
+	// as well as ErrUnreachable and ErrCircuitOpen
+	ErrUnavailable = errors.New("typesense is unavailable")
+
+	// ErrUnreachable is returned when no Typesense node could be reached
+	ErrUnreachable = fmt.Errorf("%w: no node could be reached", ErrUnavailable)
+	// ErrCircuitOpen is returned without contacting Typesense while the circuit breaker is open
+	ErrCircuitOpen = fmt.Errorf("%w: circuit breaker is open", ErrUnavailable)
+	// ErrSchemaConflict is returned when a collection can't be created with the expected schema
+	ErrSchemaConflict = errors.New("typesense collection schema conflict")
+
+	// ErrOlderEvent is returned by ReplaceEvent when the indexed version of an event is newer
+	ErrOlderEvent = errors.New("a newer version of this event is already indexed")
+	// ErrTombstoned is returned when indexing an event that was deleted before
+	ErrTombstoned = errors.New("event was deleted and can't be indexed again")
+	// ErrInvalidSignature is returned by ProcessDeletion for a deletion request that isn't
+	// signed by its author
+	ErrInvalidSignature = errors.New("event signature is invalid")
+	// ErrScanLimit is returned when matching tag filters without an indexed field
+	// would read more than MaxScannedHits search hits
+	ErrScanLimit = errors.New("query scans too many events")
+	// ErrInvalidSearch matches a SearchSyntaxError
+	ErrInvalidSearch = errors.New("invalid search string")
+)
+
+// TypesenseError is returned when Typesense answers a request with an unexpected status
+type TypesenseError struct {
+	// StatusCode of the response
+	StatusCode int
+	// Message reported by Typesense, or the raw body if it had none
+	Message string
+}
+
+func (e *TypesenseError) Error() string {
+	return fmt.Sprintf("typesense responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+// Is matches the sentinel errors corresponding to the status code
+func (e *TypesenseError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrUnavailable:
+		return temporaryStatus(e.StatusCode)
+	}
+	return false
+}
+
+// SearchSyntaxError reports a search string that can't be parsed or translated
+type SearchSyntaxError struct {
+	// Offset is the byte offset in the search string the error was found at
+	Offset int
+	// Message describes the error
+	Message string
+}
+
+func (e *SearchSyntaxError) Error() string {
+	return fmt.Sprintf("invalid search at offset %d: %s", e.Offset, e.Message)
+}
+
+// Is matches ErrInvalidSearch
+func (e *SearchSyntaxError) Is(target error) bool {
+	return target == ErrInvalidSearch
+}
+
+func syntaxError(offset int, format string, args ...any) *SearchSyntaxError {
+	return &SearchSyntaxError{Offset: offset, Message: fmt.Sprintf(format, args...)}
+}
+
+// newTypesenseError creates a TypesenseError from an unexpected response
+func newTypesenseError(resp *http.Response, body []byte) *TypesenseError {
+	var response struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Message == "" {
+		response.Message = string(body)
+	}
+
+	return &TypesenseError{StatusCode: resp.StatusCode, Message: response.Message}
+}
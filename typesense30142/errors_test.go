@@ -0,0 +1,69 @@
+package typesense30142
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypesenseError_Is(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := map[int]error{
+		http.StatusNotFound:           ErrNotFound,
+		http.StatusUnauthorized:       ErrUnauthorized,
+		http.StatusForbidden:          ErrUnauthorized,
+		http.StatusConflict:           ErrConflict,
+		http.StatusServiceUnavailable: ErrUnavailable,
+		http.StatusTooManyRequests:    ErrUnavailable,
+	}
+	sentinels := []error{ErrNotFound, ErrUnauthorized, ErrConflict, ErrUnavailable}
+
+	for status, expected := range cases {
+		err := error(&TypesenseError{StatusCode: status})
+		for _, sentinel := range sentinels {
+			assert.Equal(sentinel == expected, errors.Is(err, sentinel), "%d is %v", status, sentinel)
+		}
+	}
+
+	assert.ErrorIs(ErrUnreachable, ErrUnavailable)
+	assert.ErrorIs(ErrCircuitOpen, ErrUnavailable)
+}
+
+func TestNewTypesenseError(t *testing.T) {
+	assert := assert.New(t)
+
+	resp := &http.Response{StatusCode: http.StatusBadRequest}
+
+	err := newTypesenseError(resp, []byte(`{"message": "Could not parse the filter query."}`))
+	assert.Equal("Could not parse the filter query.", err.Message)
+	assert.Equal("typesense responded with status 400: Could not parse the filter query.", err.Error())
+
+	err = newTypesenseError(resp, []byte("Bad Request"))
+	assert.Equal("Bad Request", err.Message)
+}
+
+func TestTypedErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	server, _ := countingNode(t, http.StatusUnauthorized)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+	ctx := context.Background()
+
+	_, err := ts.SearchResources(ctx, nostr.Filter{})
+	assert.ErrorIs(err, ErrUnauthorized)
+
+	var typesenseErr *TypesenseError
+	assert.ErrorAs(err, &typesenseErr)
+	assert.Equal(http.StatusUnauthorized, typesenseErr.StatusCode)
+
+	assert.ErrorIs(ts.ReplaceEvent(ctx, createTestEvent(nostr.Tags{{"d", "resource"}})), ErrUnauthorized)
+	assert.ErrorIs(ts.DeleteEvent(ctx, createTestEvent(nostr.Tags{{"d", "resource"}})), ErrUnauthorized)
+
+	fake := newFakeTypesense(t)
+	assert.ErrorIs(fake.backend().LiftTombstone(ctx, "unknown"), ErrNotFound)
+}
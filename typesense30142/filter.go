@@ -0,0 +1,101 @@
+package typesense30142
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// fieldNamePattern matches the (nested) field names that may appear in a filter_by expression
+var fieldNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// FilterBuilder builds Typesense filter_by expressions. All string values are
+// wrapped in backticks, so that operators like && or || inside them are matched
+// literally instead of changing the meaning of the expression.
+type FilterBuilder struct {
+	expressions []string
+}
+
+// Equals adds an exact match of the field against any of the values
+func (f *FilterBuilder) Equals(field string, values ...string) *FilterBuilder {
+	return f.add(field, ":=", values)
+}
+
+// NotEquals excludes documents whose field exactly matches any of the values
+func (f *FilterBuilder) NotEquals(field string, values ...string) *FilterBuilder {
+	return f.add(field, ":!=", values)
+}
+
+// Matches adds a non-exact match of the field against any of the values
+func (f *FilterBuilder) Matches(field string, values ...string) *FilterBuilder {
+	return f.add(field, ":", values)
+}
+
+// Compare adds a numeric comparison like eventCreatedAt:>=1700000000
+func (f *FilterBuilder) Compare(field string, op string, value int64) *FilterBuilder {
+	f.expressions = append(f.expressions, fmt.Sprintf("%s:%s%d", field, op, value))
+	return f
+}
+
+// EqualsInt adds an exact match of a numeric field against any of the values
+func (f *FilterBuilder) EqualsInt(field string, values ...int) *FilterBuilder {
+	if len(values) == 0 {
+		return f
+	}
+
+	formatted := make([]string, len(values))
+	for i, value := range values {
+		formatted[i] = fmt.Sprintf("%d", value)
+	}
+	f.expressions = append(f.expressions, fmt.Sprintf("%s:=[%s]", field, strings.Join(formatted, ",")))
+	return f
+}
+
+// Expression adds an expression that was already built, wrapping it in parentheses
+func (f *FilterBuilder) Expression(expression string) *FilterBuilder {
+	if expression != "" {
+		f.expressions = append(f.expressions, "("+expression+")")
+	}
+	return f
+}
+
+// Empty reports whether no expression was added
+func (f *FilterBuilder) Empty() bool {
+	return len(f.expressions) == 0
+}
+
+// String joins all expressions with &&
+func (f *FilterBuilder) String() string {
+	return strings.Join(f.expressions, " && ")
+}
+
+func (f *FilterBuilder) add(field string, op string, values []string) *FilterBuilder {
+	if len(values) == 0 {
+		return f
+	}
+
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = QuoteFilterValue(value)
+	}
+
+	if len(quoted) == 1 {
+		f.expressions = append(f.expressions, field+op+quoted[0])
+	} else {
+		f.expressions = append(f.expressions, field+op+"["+strings.Join(quoted, ",")+"]")
+	}
+	return f
+}
+
+// QuoteFilterValue wraps a value in backticks for use in a filter_by expression,
+// escaping backslashes and backticks inside the value
+func QuoteFilterValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "`", "\\`")
+	return "`" + value + "`"
+}
+
+// validFieldName reports whether name can safely be used as a field in a filter_by expression
+func validFieldName(name string) bool {
+	return fieldNamePattern.MatchString(name)
+}
@@ -0,0 +1,103 @@
+package typesense30142
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+// adversarialDTags try to break out of a filter_by value or the query string
+var adversarialDTags = []struct {
+	d      string
+	quoted string
+}{
+	{"resource-1", "`resource-1`"},
+	{"x && eventPubKey:!=abc", "`x && eventPubKey:!=abc`"},
+	{"x || d:*", "`x || d:*`"},
+	{"x` || d:!=`y", "`x\\` || d:!=\\`y`"},
+	{"x\\` || d:!=`y", "`x\\\\\\` || d:!=\\`y`"},
+	{"x&filter_by=d:*", "`x&filter_by=d:*`"},
+	{"x,y]", "`x,y]`"},
+	{"(a) && [b]", "`(a) && [b]`"},
+}
+
+func TestQuoteFilterValue(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, tc := range adversarialDTags {
+		assert.Equal(tc.quoted, QuoteFilterValue(tc.d), tc.d)
+	}
+}
+
+func TestFilterBuilder(t *testing.T) {
+	assert := assert.New(t)
+
+	filterBy := (&FilterBuilder{}).
+		Equals("d", "a && b").
+		Equals("eventPubKey", "pk1", "pk2").
+		EqualsInt("eventKind", 30142).
+		NotEquals("id", "doc`id").
+		Compare("eventCreatedAt", "<=", 1700000000).
+		Expression("keywords:`x` || keywords:`y`").
+		Equals("ignored")
+
+	assert.Equal("d:=`a && b` && eventPubKey:=[`pk1`,`pk2`] && eventKind:=[30142] && id:!=`doc\\`id` && eventCreatedAt:<=1700000000 && (keywords:`x` || keywords:`y`)", filterBy.String())
+	assert.True((&FilterBuilder{}).Empty())
+}
+
+func TestProcessDeletion_AdversarialDTags(t *testing.T) {
+	for _, tc := range adversarialDTags {
+		t.Run(tc.d, func(t *testing.T) {
+			assert := assert.New(t)
+
+			fake := newFakeTypesense(t)
+			ts := fake.backend()
+			sk := nostr.GeneratePrivateKey()
+			pubkey, _ := nostr.GetPublicKey(sk)
+			deletion := &nostr.Event{Kind: nostr.KindDeletion, CreatedAt: 1700000000, Tags: nostr.Tags{{"a", "30142:" + pubkey + ":" + tc.d}}}
+			deletion.Sign(sk)
+
+			_, err := ts.ProcessDeletion(context.Background(), deletion)
+			assert.NoError(err)
+			assert.Equal([]string{
+				"eventKind:=[30142] && eventPubKey:=`" + pubkey + "` && d:=" + tc.quoted + " && eventCreatedAt:<=1700000000",
+			}, fake.deleteFilters)
+		})
+	}
+}
+
+func TestBuildTypesenseQuery_Quoting(t *testing.T) {
+	assert := assert.New(t)
+
+	query, err := ParseSearchQuery("keywords:a||b")
+	assert.NoError(err)
+	_, params, err := BuildTypesenseQuery(query)
+	assert.NoError(err)
+	assert.Equal("keywords:=`a||b`", params["filter_by"])
+
+	_, err = ParseSearchQuery("name||d:x")
+	assert.Error(err)
+}
+
+func TestSearchPage_EncodesParameters(t *testing.T) {
+	assert := assert.New(t)
+
+	var query map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte(`{"found": 0, "hits": []}`))
+	}))
+	defer server.Close()
+
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	_, err := ts.SearchResources(context.Background(), nostr.Filter{Tags: nostr.TagMap{"d": {"x&per_page=1"}}, Search: "a&b"})
+	assert.NoError(err)
+	assert.Equal([]string{"a&b"}, query["q"])
+	assert.Equal([]string{"d:=`x&per_page=1`"}, query["filter_by"])
+	assert.Equal([]string{"250"}, query["per_page"])
+}
@@ -1,25 +1,83 @@
 package typesense30142
 
 import (
-	"context"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/fiatjaf/eventstore"
-	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var _ eventstore.Store = (*TSBackend)(nil)
+var (
+	_ eventstore.Store   = (*TSBackend)(nil)
+	_ eventstore.Counter = (*TSBackend)(nil)
+)
 
 type TSBackend struct {
-	ApiKey         string
-	Host           string
+	ApiKey string
+	// Host is the base URL of a single Typesense node
+	Host string
+	// Nodes are the base URLs of the nodes of a Typesense cluster, used instead
+	// of Host when set. Requests rotate between the healthy nodes.
+	Nodes []string
+	// NearestNode is preferred over Nodes as long as it is healthy
+	NearestNode string
+	// NodeCooldown is how long a node is skipped after a network error or a
+	// 5xx response. Defaults to 60s.
+	NodeCooldown   time.Duration
 	CollectionName string
+	// MaxLimit caps the number of events a single query returns, also when
+	// the filter has no or a higher limit. Defaults to 1000.
+	MaxLimit int
+	// MaxScannedHits caps the search hits a single query reads to match tag
+	// filters without an indexed field against the raw events. Defaults to 10000.
+	MaxScannedHits int
+	// TombstoneCollectionName is the collection recording deleted events.
+	// Defaults to CollectionName with a "_tombstones" suffix.
+	TombstoneCollectionName string
+	// Schema customizes the AMB collection, e.g. with facets and locales
+	Schema SchemaOptions
+	// DropOldCollection makes Reindex delete the collection it replaced
+	DropOldCollection bool
+
+	// HTTPClient is used for all requests to Typesense. Defaults to a client
+	// shared by all backends that pools connections.
+	HTTPClient *http.Client
+	// SearchTimeout limits searches and document lookups. Defaults to 10s.
+	SearchTimeout time.Duration
+	// WriteTimeout limits indexing and deleting documents. Defaults to 10s.
+	WriteTimeout time.Duration
+	// AdminTimeout limits collection management and exports. Defaults to 30s.
+	AdminTimeout time.Duration
+	// ReindexTimeout limits exporting a collection during Reindex. Defaults to 30m.
+	ReindexTimeout time.Duration
+	// Retry configures retries of failed requests that are safe to repeat
+	Retry RetryPolicy
+	// CircuitBreaker configures when requests fail fast while Typesense is down
+	CircuitBreaker CircuitBreakerConfig
+	// Logger receives diagnostics such as skipped documents and failed
+	// requests. Defaults to discarding them.
+	Logger *slog.Logger
+	// Metrics receives counts of written events, search latencies and
+	// Typesense responses. Defaults to dropping them.
+	Metrics Metrics
+	// TracerProvider creates the spans of queries, replacements and requests
+	// to Typesense. Defaults to the global provider of OpenTelemetry.
+	TracerProvider trace.TracerProvider
+
+	// documentLocks serialize replacements of the same document, see lockDocument
+	documentLocks [64]sync.Mutex
+	breaker       circuitBreaker
+	nodes         nodePool
 }
 
 func (ts *TSBackend) Init() error {
 	err := ts.CheckOrCreateCollection()
 	if err != nil {
-		return fmt.Errorf("Failed to check/create collection: %v", err)
+		return fmt.Errorf("failed to check/create collection: %w", err)
 	}
 
 	return nil
@@ -27,4 +85,12 @@ func (ts *TSBackend) Init() error {
 
 func (ts *TSBackend) Close() {}
 
-func (ts *TSBackend) SaveEvent(ctx context.Context, event *nostr.Event) error {return nil}
+// logger returns the configured logger or one that discards everything
+func (ts *TSBackend) logger() *slog.Logger {
+	if ts.Logger != nil {
+		return ts.Logger
+	}
+	return discardLogger
+}
+
+var discardLogger = slog.New(slog.DiscardHandler)
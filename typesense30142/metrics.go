@@ -0,0 +1,58 @@
+package typesense30142
+
+import "time"
+
+// EventResult is the outcome of writing an event, as counted by Metrics
+type EventResult string
+
+const (
+	// EventIndexed counts events added to the index
+	EventIndexed EventResult = "indexed"
+	// EventReplaced counts events that replaced an older version of their address
+	EventReplaced EventResult = "replaced"
+	// EventDeleted counts documents removed from the index
+	EventDeleted EventResult = "deleted"
+	// EventRejected counts duplicates, outdated versions and deleted events
+	// that were refused
+	EventRejected EventResult = "rejected"
+)
+
+// Reasons for skipping search hits, as counted by Metrics
+const (
+	SkipMissingDocument = "missing_document"
+	SkipMissingEventRaw = "missing_event_raw"
+	SkipInvalidEventRaw = "invalid_event_raw"
+)
+
+// Metrics receives measurements of the store. Implementations must be safe for
+// concurrent use, an adapter to Prometheus maps every method onto a counter or
+// histogram vector.
+type Metrics interface {
+	// CountEvents adds n events with the result
+	CountEvents(result EventResult, n int)
+	// ObserveSearch records the latency and the number of hits of a search request
+	ObserveSearch(latency time.Duration, hits int)
+	// CountResponse counts a response of Typesense to a request of the endpoint,
+	// such as "search", "upsert" or "collection". Status is 0 if no response
+	// was received.
+	CountResponse(endpoint string, status int)
+	// CountSkippedDocument counts a search hit that couldn't be converted back
+	// into an event
+	CountSkippedDocument(reason string)
+}
+
+// noopMetrics is used when TSBackend.Metrics is not set
+type noopMetrics struct{}
+
+func (noopMetrics) CountEvents(EventResult, int)     {}
+func (noopMetrics) ObserveSearch(time.Duration, int) {}
+func (noopMetrics) CountResponse(string, int)        {}
+func (noopMetrics) CountSkippedDocument(string)      {}
+
+// metrics returns the configured metrics or ones that are dropped
+func (ts *TSBackend) metrics() Metrics {
+	if ts.Metrics != nil {
+		return ts.Metrics
+	}
+	return noopMetrics{}
+}
@@ -0,0 +1,122 @@
+package typesense30142
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMetrics keeps every measurement in memory
+type recordingMetrics struct {
+	mu        sync.Mutex
+	events    map[EventResult]int
+	searches  []int
+	responses map[string][]int
+	skipped   map[string]int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{
+		events:    map[EventResult]int{},
+		responses: map[string][]int{},
+		skipped:   map[string]int{},
+	}
+}
+
+func (m *recordingMetrics) CountEvents(result EventResult, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events[result] += n
+}
+
+func (m *recordingMetrics) ObserveSearch(latency time.Duration, hits int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.searches = append(m.searches, hits)
+}
+
+func (m *recordingMetrics) CountResponse(endpoint string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.responses[endpoint] = append(m.responses[endpoint], status)
+}
+
+func (m *recordingMetrics) CountSkippedDocument(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.skipped[reason]++
+}
+
+func TestMetrics_Events(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	fake.numDeleted = 1
+	metrics := newRecordingMetrics()
+	ts := fake.backend()
+	ts.Metrics = metrics
+	sk := nostr.GeneratePrivateKey()
+	ctx := context.Background()
+
+	older := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	older.Sign(sk)
+	newer := &nostr.Event{Kind: 30142, CreatedAt: 2000, Tags: nostr.Tags{{"d", "resource"}}}
+	newer.Sign(sk)
+	note := &nostr.Event{Kind: 1, CreatedAt: 1000, Content: "note"}
+	note.Sign(sk)
+
+	assert.NoError(ts.SaveEvent(ctx, note))
+	assert.ErrorIs(ts.SaveEvent(ctx, note), eventstore.ErrDupEvent)
+	assert.NoError(ts.SaveEvent(ctx, older))
+	assert.NoError(ts.SaveEvent(ctx, newer))
+	assert.ErrorIs(ts.ReplaceEvent(ctx, older), ErrOlderEvent)
+	assert.NoError(ts.DeleteEvent(ctx, newer))
+	assert.ErrorIs(ts.SaveEvent(ctx, newer), ErrTombstoned)
+
+	assert.Equal(map[EventResult]int{
+		EventIndexed:  2,
+		EventReplaced: 1,
+		EventDeleted:  1,
+		EventRejected: 3,
+	}, metrics.events)
+	assert.Equal([]int{http.StatusCreated, http.StatusConflict}, metrics.responses["create"])
+}
+
+func TestMetrics_Search(t *testing.T) {
+	assert := assert.New(t)
+
+	event := createTestEvent(nostr.Tags{{"d", "resource-1"}})
+	raw, _ := eventToStringifiedJSON(event)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"found": 4, "page": 1, "hits": []map[string]any{
+			{"document": map[string]any{"eventRaw": raw}},
+			{"document": map[string]any{}},
+			{"document": map[string]any{"eventRaw": "{"}},
+			{},
+		}})
+	}))
+	defer server.Close()
+
+	metrics := newRecordingMetrics()
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Metrics: metrics}
+
+	events, err := ts.SearchResources(context.Background(), nostr.Filter{})
+	assert.NoError(err)
+	assert.Len(events, 1)
+
+	assert.Equal([]int{4}, metrics.searches)
+	assert.Equal([]int{http.StatusOK}, metrics.responses["search"])
+	assert.Equal(map[string]int{
+		SkipMissingDocument: 1,
+		SkipMissingEventRaw: 1,
+		SkipInvalidEventRaw: 1,
+	}, metrics.skipped)
+}
@@ -0,0 +1,119 @@
+package typesense30142
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultNodeCooldown is how long a failed node is skipped when NodeCooldown is not set
+const defaultNodeCooldown = 60 * time.Second
+
+// nodePool keeps track of the health of the Typesense nodes and rotates between them
+type nodePool struct {
+	mu   sync.Mutex
+	next int
+	// unhealthyUntil holds the nodes that failed recently
+	unhealthyUntil map[string]time.Time
+}
+
+// clusterNodes returns the base URLs of all configured nodes, falling back to Host.
+// The URLs are normalized, so that they can be used as keys of the node health.
+func (ts *TSBackend) clusterNodes() []string {
+	if len(ts.Nodes) == 0 {
+		return []string{normalizeNode(ts.Host)}
+	}
+
+	nodes := make([]string, len(ts.Nodes))
+	for i, node := range ts.Nodes {
+		nodes[i] = normalizeNode(node)
+	}
+	return nodes
+}
+
+// normalizeNode strips the trailing slash of a node URL, paths are appended to it
+func normalizeNode(node string) string {
+	return strings.TrimSuffix(node, "/")
+}
+
+// nodeCount returns the number of distinct nodes requests can be sent to
+func (ts *TSBackend) nodeCount() int {
+	count := len(ts.clusterNodes())
+	if ts.NearestNode != "" {
+		count++
+	}
+	return count
+}
+
+// nextNode picks the node for the next request: the nearest node while it is
+// healthy, otherwise the healthy nodes in turn. If all nodes failed recently
+// the next one in turn is tried anyway.
+func (ts *TSBackend) nextNode() string {
+	return ts.nodes.pick(normalizeNode(ts.NearestNode), ts.clusterNodes())
+}
+
+func (p *nodePool) pick(nearest string, nodes []string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if nearest != "" && p.healthy(nearest, now) {
+		return nearest
+	}
+
+	for i := range nodes {
+		index := (p.next + i) % len(nodes)
+		if p.healthy(nodes[index], now) {
+			p.next = index + 1
+			return nodes[index]
+		}
+	}
+
+	index := p.next % len(nodes)
+	p.next = index + 1
+	return nodes[index]
+}
+
+func (p *nodePool) healthy(node string, now time.Time) bool {
+	return !now.Before(p.unhealthyUntil[node])
+}
+
+// record marks a node unhealthy for the cooldown after a failure and healthy
+// after a success. The node is the normalized URL returned by pick.
+func (p *nodePool) record(node string, failed bool, cooldown time.Duration) {
+	if cooldown <= 0 {
+		cooldown = defaultNodeCooldown
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !failed {
+		delete(p.unhealthyUntil, node)
+		return
+	}
+
+	if p.unhealthyUntil == nil {
+		p.unhealthyUntil = map[string]time.Time{}
+	}
+	p.unhealthyUntil[node] = time.Now().Add(cooldown)
+}
+
+// nodeFailure reports whether the outcome of a request says that the node
+// itself is unhealthy. Unlike temporaryFailure it leaves out 408 and 429, which
+// Typesense answers when the cluster as a whole is busy.
+func nodeFailure(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
+
+// notSent reports whether the request failed before it reached the node
+func notSent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,168 @@
+package typesense30142
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingNode is a Typesense node answering every request with the status
+func countingNode(t *testing.T, status int) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+		w.Write([]byte(`{"found": 0, "hits": []}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// deadNode returns the URL of a node that refuses connections
+func deadNode() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func TestNodes_RoundRobin(t *testing.T) {
+	assert := assert.New(t)
+
+	first, firstRequests := countingNode(t, http.StatusOK)
+	second, secondRequests := countingNode(t, http.StatusOK)
+	ts := &TSBackend{Nodes: []string{first.URL, second.URL + "/"}, CollectionName: "amb"}
+
+	for range 4 {
+		_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+		assert.NoError(err)
+	}
+
+	assert.Equal(int32(2), firstRequests.Load())
+	assert.Equal(int32(2), secondRequests.Load())
+}
+
+func TestNodes_NearestNode(t *testing.T) {
+	assert := assert.New(t)
+
+	nearest, nearestRequests := countingNode(t, http.StatusOK)
+	other, otherRequests := countingNode(t, http.StatusOK)
+	ts := &TSBackend{NearestNode: nearest.URL, Nodes: []string{other.URL}, CollectionName: "amb"}
+
+	for range 3 {
+		_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+		assert.NoError(err)
+	}
+
+	assert.Equal(int32(3), nearestRequests.Load())
+	assert.Equal(int32(0), otherRequests.Load())
+}
+
+func TestNodes_Failover(t *testing.T) {
+	assert := assert.New(t)
+
+	failing, failingRequests := countingNode(t, http.StatusServiceUnavailable)
+	healthy, healthyRequests := countingNode(t, http.StatusOK)
+	ts := &TSBackend{
+		NearestNode:    deadNode(),
+		Nodes:          []string{failing.URL, healthy.URL},
+		CollectionName: "amb",
+		Retry:          RetryPolicy{BaseDelay: time.Millisecond},
+	}
+
+	// nearest node refuses connections, the first cluster node answers 503
+	_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+	assert.NoError(err)
+	assert.Equal(int32(1), failingRequests.Load())
+	assert.Equal(int32(1), healthyRequests.Load())
+
+	// both failed nodes are skipped during their cooldown
+	for range 3 {
+		_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+		assert.NoError(err)
+	}
+	assert.Equal(int32(1), failingRequests.Load())
+	assert.Equal(int32(4), healthyRequests.Load())
+}
+
+func TestNodes_FailoverForCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	healthy, healthyRequests := countingNode(t, http.StatusCreated)
+	ts := &TSBackend{
+		Nodes:          []string{deadNode(), healthy.URL},
+		CollectionName: "amb",
+		Retry:          RetryPolicy{BaseDelay: time.Millisecond},
+	}
+
+	// creates aren't retried, unless the request never reached a node
+	resp, _, err := ts.makehttpRequest(context.Background(), opCreate, ts.documentsPath("", nil), http.MethodPost, []byte(`{}`))
+
+	assert.NoError(err)
+	assert.Equal(http.StatusCreated, resp.StatusCode)
+	assert.Equal(int32(1), healthyRequests.Load())
+}
+
+func TestNodes_CooldownExpires(t *testing.T) {
+	assert := assert.New(t)
+
+	pool := &nodePool{}
+	nodes := []string{"http://a", "http://b"}
+
+	pool.record("http://a", true, 20*time.Millisecond)
+	assert.Equal("http://b", pool.pick("", nodes))
+	assert.Equal("http://b", pool.pick("", nodes))
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal("http://a", pool.pick("", nodes))
+	assert.Equal("http://b", pool.pick("", nodes))
+}
+
+func TestNodes_FailoverTrailingSlash(t *testing.T) {
+	assert := assert.New(t)
+
+	failing, failingRequests := countingNode(t, http.StatusServiceUnavailable)
+	healthy, healthyRequests := countingNode(t, http.StatusOK)
+	ts := &TSBackend{
+		NearestNode:    failing.URL + "/",
+		Nodes:          []string{healthy.URL + "/"},
+		CollectionName: "amb",
+		Retry:          RetryPolicy{BaseDelay: time.Millisecond},
+	}
+
+	for range 3 {
+		_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+		assert.NoError(err)
+	}
+
+	// the nearest node is skipped during its cooldown despite the trailing slash
+	assert.Equal(int32(1), failingRequests.Load())
+	assert.Equal(int32(3), healthyRequests.Load())
+}
+
+func TestNodes_RateLimitKeepsNodeHealthy(t *testing.T) {
+	assert := assert.New(t)
+
+	limited, limitedRequests := countingNode(t, http.StatusTooManyRequests)
+	other, otherRequests := countingNode(t, http.StatusOK)
+	ts := &TSBackend{
+		NearestNode:    limited.URL,
+		Nodes:          []string{other.URL},
+		CollectionName: "amb",
+		Retry:          RetryPolicy{MaxAttempts: 1},
+	}
+
+	// 429 is rate limiting of the cluster, the nearest node stays preferred
+	for range 2 {
+		_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+		assert.Error(err)
+	}
+
+	assert.Equal(int32(2), limitedRequests.Load())
+	assert.Equal(int32(0), otherRequests.Load())
+}
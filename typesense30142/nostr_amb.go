@@ -29,6 +29,7 @@ func NostrToAMB(event *nostr.Event) (*AMBMetadata, error) {
 		return nil, fmt.Errorf("error converting event to JSON: %w", err)
 	}
 	amb := &AMBMetadata{
+		ID:   event.ID,
 		Type: []string{"LearningResource"},
 		NostrMetadata: NostrMetadata{
 			EventID:        event.ID,
@@ -67,7 +68,6 @@ func NostrToAMB(event *nostr.Event) (*AMBMetadata, error) {
 		case "d":
 			if len(tag) >= 2 {
 				amb.D = tag[1]
-				amb.ID = event.ID
 			}
 		case "type":
 			if len(tag) >= 2 {
@@ -339,6 +339,8 @@ func NostrToAMB(event *nostr.Event) (*AMBMetadata, error) {
 		}
 	}
 
+	amb.setShadowFields()
+
 	return amb, nil
 }
 
@@ -3,296 +3,436 @@ package typesense30142
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxPerPage is the largest page size Typesense accepts
+	maxPerPage = 250
+	// defaultMaxLimit caps the number of events returned by a single query
+	// when TSBackend.MaxLimit is not set
+	defaultMaxLimit = 1000
+	// defaultMaxScannedHits caps the hits read for tag filters without an
+	// indexed field when TSBackend.MaxScannedHits is not set
+	defaultMaxScannedHits = 10000
 )
 
 func (ts *TSBackend) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
 	ch := make(chan *nostr.Event)
 
-	log.Printf("Processing query with search: %s", filter.Search)
-	
-	// If we have no search parameter, return an empty channel
-	if filter.Search == "" {
-		log.Printf("No search parameter provided, returning empty result")
+	// The span ends once all events were sent
+	ctx, span := ts.startSpan(ctx, "typesense.QueryEvents", filterAttrs(filter)...)
+
+	limit := ts.queryLimit(filter)
+	if limit == 0 {
 		close(ch)
+		endSpan(span, nil)
 		return ch, nil
 	}
 
-	nostrsearch, err := ts.SearchResources(filter.Search)
+	query, err := buildQuery(ctx, filter)
+	if err != nil {
+		close(ch)
+		endSpan(span, err)
+		return ch, fmt.Errorf("search failed: %w", err)
+	}
+
+	// Fetch the first page right away so that failures reach the caller
+	perPage := min(limit, maxPerPage)
+	firstPage, err := ts.searchPage(ctx, query, 1, perPage)
 	if err != nil {
-		log.Printf("Search failed: %v", err)
+		ts.logger().ErrorContext(ctx, "search failed", "search", filter.Search, "error", err)
 		// Return the channel anyway, but close it immediately
 		close(ch)
+		endSpan(span, err)
 		return ch, fmt.Errorf("search failed: %w", err)
 	}
 
-	log.Printf("Search succeeded, found %d events", len(nostrsearch))
+	ts.logger().DebugContext(ctx, "search succeeded", "search", filter.Search, "found", firstPage.Found)
 
 	go func() {
-		// Check if context is done before sending events
-		select {
-		case <-ctx.Done():
-			log.Printf("Context cancelled before sending results")
-			close(ch)
-			return
-		default:
-			for _, evt := range nostrsearch {
-				select {
-				case <-ctx.Done():
-					// Context was cancelled during event sending
-					log.Printf("Context cancelled during event sending")
-					break
-				default:
-					// Send the event
-					ch <- &evt
-				}
+		defer close(ch)
+
+		sent := 0
+		err := ts.searchPages(ctx, query, limit, firstPage, func(evt nostr.Event) bool {
+			select {
+			case <-ctx.Done():
+				ts.logger().DebugContext(ctx, "query cancelled while sending events", "error", ctx.Err())
+				return false
+			case ch <- &evt:
+				sent++
+				return true
 			}
-			close(ch)
+		})
+		if errors.Is(err, ErrScanLimit) {
+			// Like with MaxLimit, the events found so far are the result
+			ts.logger().WarnContext(ctx, "query stopped at the scan limit", "search", filter.Search, "events", sent)
+			err = nil
+		}
+		if err != nil {
+			ts.logger().ErrorContext(ctx, "search failed while paging", "search", filter.Search, "error", err)
 		}
+
+		span.SetAttributes(attrResultCount.Int(sent))
+		endSpan(span, err)
 	}()
-	
+
 	return ch, nil
 }
 
-// searches for resources and returns both the AMB metadata and converted Nostr events
-func (ts *TSBackend) SearchResources(searchStr string) ([]nostr.Event, error) {
-	parsedQuery := ParseSearchQuery(searchStr)
+// searches for resources matching the nostr filter and returns the converted Nostr events
+func (ts *TSBackend) SearchResources(ctx context.Context, filter nostr.Filter) (events []nostr.Event, err error) {
+	ctx, span := ts.startSpan(ctx, "typesense.SearchResources", filterAttrs(filter)...)
+	defer func() {
+		span.SetAttributes(attrResultCount.Int(len(events)))
+		endSpan(span, err)
+	}()
 
-	mainQuery, params, err := BuildTypesenseQuery(parsedQuery)
+	limit := ts.queryLimit(filter)
+	if limit == 0 {
+		return []nostr.Event{}, nil
+	}
+
+	query, err := buildQuery(ctx, filter)
 	if err != nil {
-		return nil, fmt.Errorf("error building Typesense query: %v", err)
+		return nil, err
 	}
 
-	// URL encode the main query
-	encodedQuery := url.QueryEscape(mainQuery)
+	events = make([]nostr.Event, 0, min(limit, maxPerPage))
+	err = ts.searchPages(ctx, query, limit, nil, func(evt nostr.Event) bool {
+		events = append(events, evt)
+		return true
+	})
+	if errors.Is(err, ErrScanLimit) {
+		ts.logger().WarnContext(ctx, "query stopped at the scan limit", "search", filter.Search, "events", len(events))
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	// Default fields to search in
-	queryBy := "name,description,about,learningResourceType,keywords,creator,publisher"
+	return events, nil
+}
 
-	// Start building the search URL
-	searchURL := fmt.Sprintf("%s/collections/%s/documents/search?validate_field_names=false&q=%s&query_by=%s",
-		ts.Host, ts.CollectionName, encodedQuery, queryBy)
+// queryLimit returns how many events a query for the filter may return at most
+func (ts *TSBackend) queryLimit(filter nostr.Filter) int {
+	if filter.LimitZero {
+		return 0
+	}
 
-	// Add additional parameters
-	for key, value := range params {
-		searchURL += fmt.Sprintf("&%s=%s", key, url.QueryEscape(value))
+	maxLimit := ts.MaxLimit
+	if maxLimit <= 0 {
+		maxLimit = defaultMaxLimit
 	}
 
-	// Debug information
-	fmt.Printf("Search URL: %s\n", searchURL)
+	if filter.Limit > 0 && filter.Limit < maxLimit {
+		return filter.Limit
+	}
+	return maxLimit
+}
+
+// TypesenseQuery is a nostr filter translated into Typesense search parameters
+type TypesenseQuery struct {
+	// Q is the text query, "*" when matching all documents
+	Q string
+	// Params holds filter_by, sort_by and other Typesense parameters
+	Params map[string]string
+	// UnindexedTags are tag filters that can only be matched against the raw events
+	UnindexedTags nostr.TagMap
+}
+
+// BuildQuery translates a nostr filter, including its NIP-50 search string, into a TypesenseQuery
+func BuildQuery(filter nostr.Filter) (*TypesenseQuery, error) {
+	return buildQuery(context.Background(), filter)
+}
 
-	resp, body, err := ts.makehttpRequest(searchURL, http.MethodGet, nil)
+// buildQuery is BuildQuery with spans for parsing and translating the search
+// string, recorded by the tracer of the span in ctx
+func buildQuery(ctx context.Context, filter nostr.Filter) (*TypesenseQuery, error) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
 
+	_, span := tracer.Start(ctx, "typesense.ParseSearchQuery", trace.WithAttributes(attrFilterSearch.String(filter.Search)))
+	parsedQuery, err := ParseSearchQuery(filter.Search)
+	endSpan(span, err)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return nil, err
 	}
 
-	// Check for errors
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("search failed with status code %d: %s", resp.StatusCode, string(body))
+	_, span = tracer.Start(ctx, "typesense.BuildTypesenseQuery")
+	mainQuery, params, err := BuildTypesenseQuery(parsedQuery)
+	if err != nil {
+		endSpan(span, err)
+		return nil, fmt.Errorf("error building Typesense query: %w", err)
 	}
 
-	// Try to parse the raw JSON to understand its structure
-	var rawResponse interface{}
-	if err := json.Unmarshal(body, &rawResponse); err != nil {
-		fmt.Printf("Warning: Could not parse raw response as JSON: %v\n", err)
-	} else {
-		// Check if we got a hits array
-		responseMap, ok := rawResponse.(map[string]interface{})
-		if ok {
-			if hits, exists := responseMap["hits"]; exists {
-				hitsArray, ok := hits.([]interface{})
-				if ok {
-					fmt.Printf("Response contains %d hits\n", len(hitsArray))
-					if len(hitsArray) > 0 {
-						// Look at the structure of the first hit
-						firstHit, ok := hitsArray[0].(map[string]interface{})
-						if ok {
-							fmt.Printf("First hit keys: %v\n", getMapKeys(firstHit))
-						}
-					}
-				}
-			}
+	// Combine the search filters with the ids, authors and kinds of the nostr filter
+	filterBy := nostrFilterExpressions(filter)
+	if searchFilter, ok := params["filter_by"]; ok {
+		filterBy.Expression(searchFilter)
+	}
+	if !filterBy.Empty() {
+		params["filter_by"] = filterBy.String()
+	}
+
+	// Without any search terms we match all documents, rely on filter_by and
+	// return the newest events first like other eventstores do, unless the
+	// search asks for another order
+	if mainQuery == "" {
+		mainQuery = "*"
+		if _, ok := params["sort_by"]; !ok {
+			params["sort_by"] = sortOrders["newest"]
 		}
 	}
 
-	return parseSearchResponse(body)
-}
+	// Hits are read from eventRaw, the internal shadow fields aren't needed
+	params["exclude_fields"] = strings.Join(shadowFields, ",")
+
+	span.SetAttributes(attrQuery.String(mainQuery), attrFilterBy.String(params["filter_by"]))
+	span.End()
 
-// SearchQuery represents a parsed search query with raw terms and field filters
-type SearchQuery struct {
-	RawTerms     []string
-	FieldFilters map[string][]string // Changed from map[string]string to map[string][]string to support multiple values
+	return &TypesenseQuery{
+		Q:             mainQuery,
+		Params:        params,
+		UnindexedTags: unindexedTags(filter),
+	}, nil
 }
 
-// ParseSearchQuery parses a search string with support for quoted terms and field:value pairs
-func ParseSearchQuery(searchStr string) SearchQuery {
-	var query SearchQuery
-	query.RawTerms = []string{}
-	query.FieldFilters = make(map[string][]string) // Initialize as map to array of strings
-
-	// Regular expression to match quoted strings and field:value pairs
-	// This regex handles:
-	// 1. Quoted strings (preserving spaces and everything inside)
-	// 2. Field:value pairs
-	// 3. Regular words
-	re := regexp.MustCompile(`"([^"]+)"|(\S+\.\S+):(\S+)|(\S+)`)
-	matches := re.FindAllStringSubmatch(searchStr, -1)
-
-	for _, match := range matches {
-		if match[1] != "" {
-			// This is a quoted string, add it to raw terms
-			query.RawTerms = append(query.RawTerms, match[1])
-		} else if match[2] != "" && match[3] != "" {
-			// This is a field:value pair with dot notation
-			fieldName := match[2]
-			fieldValue := match[3]
-			
-			// Add to the array of values for this field
-			query.FieldFilters[fieldName] = append(query.FieldFilters[fieldName], fieldValue)
-		} else if match[4] != "" {
-			// This is a regular word, check if it's a simple field:value
-			parts := strings.SplitN(match[4], ":", 2)
-			if len(parts) == 2 && !strings.Contains(parts[0], ".") {
-				// Simple field:value without dot notation
-				fieldName := parts[0]
-				fieldValue := parts[1]
-				
-				// Add to the array of values for this field
-				query.FieldFilters[fieldName] = append(query.FieldFilters[fieldName], fieldValue)
-			} else {
-				// Regular search term
-				query.RawTerms = append(query.RawTerms, match[4])
+// searchPages runs the query page by page and hands every matching event to yield
+// until limit events were yielded, all hits were consumed or yield returns false.
+// If firstPage is given it is used instead of fetching the first page again.
+// Queries with tag filters without an indexed field stop with ErrScanLimit once
+// MaxScannedHits hits were read.
+func (ts *TSBackend) searchPages(ctx context.Context, query *TypesenseQuery, limit int, firstPage *SearchResponse, yield func(nostr.Event) bool) error {
+	perPage := min(limit, maxPerPage)
+	yielded := 0
+	scanned := 0
+
+	for page := 1; ; page++ {
+		response := firstPage
+		if page > 1 || response == nil {
+			var err error
+			response, err = ts.searchPage(ctx, query, page, perPage)
+			if err != nil {
+				return err
+			}
+		}
+
+		scanned += len(response.Hits)
+		for _, evt := range ts.eventsFromHits(ctx, response.Hits) {
+			// Tags without an indexed counterpart are matched against the raw events
+			if !matchesTags(&evt, query.UnindexedTags) {
+				continue
+			}
+
+			if !yield(evt) {
+				return nil
+			}
+
+			yielded++
+			if yielded >= limit {
+				return nil
 			}
 		}
+
+		if len(response.Hits) < perPage || page*perPage >= response.Found {
+			return nil
+		}
+		if len(query.UnindexedTags) > 0 && scanned >= ts.maxScannedHits() {
+			return ErrScanLimit
+		}
 	}
+}
 
-	return query
+func (ts *TSBackend) maxScannedHits() int {
+	if ts.MaxScannedHits <= 0 {
+		return defaultMaxScannedHits
+	}
+	return ts.MaxScannedHits
 }
 
-// BuildTypesenseQuery builds a Typesense search query from a parsed SearchQuery
-func BuildTypesenseQuery(query SearchQuery) (string, map[string]string, error) {
-	// Join raw terms for the main query
-	mainQuery := strings.Join(query.RawTerms, " ")
+// searchPage fetches a single page of search results from Typesense
+func (ts *TSBackend) searchPage(ctx context.Context, query *TypesenseQuery, page int, perPage int) (*SearchResponse, error) {
+	params := url.Values{}
+	params.Set("validate_field_names", "false")
+	params.Set("q", query.Q)
+	// Default fields to search in
+	params.Set("query_by", "name,description,about,learningResourceType,keywords,creator,publisher")
+	params.Set("page", strconv.Itoa(page))
+	params.Set("per_page", strconv.Itoa(perPage))
+
+	// Add additional parameters
+	for key, value := range query.Params {
+		params.Set(key, value)
+	}
 
-	// Parameters for filter_by and other Typesense parameters
-	params := make(map[string]string)
+	path := ts.documentsPath("/search", params)
 
-	// Group filter expressions by base field name
-	fieldGroups := make(map[string][]string)
+	start := time.Now()
+	resp, body, err := ts.makehttpRequest(ctx, opSearch, path, http.MethodGet, nil)
+	if err != nil {
+		return nil, fmt.Errorf("search request failed: %w", err)
+	}
+
+	// Check for errors
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("search failed: %w", newTypesenseError(resp, body))
+	}
+
+	var searchResponse SearchResponse
+	if err := json.Unmarshal(body, &searchResponse); err != nil {
+		return nil, fmt.Errorf("error parsing search response: %v", err)
+	}
+
+	latency := time.Since(start)
+	ts.metrics().ObserveSearch(latency, len(searchResponse.Hits))
+	ts.logger().DebugContext(ctx, "search page fetched",
+		"page", page,
+		"per_page", perPage,
+		"found", searchResponse.Found,
+		"hits", len(searchResponse.Hits),
+		"latency", latency)
+
+	return &searchResponse, nil
+}
 
-	for field, values := range query.FieldFilters {
-		// Extract the base field name (part before the first dot)
-		baseName := field
-		if dotIndex := strings.Index(field, "."); dotIndex != -1 {
-			baseName = field[:dotIndex]
+// tagFields maps nostr tag names to the indexed AMB fields they end up in
+var tagFields = map[string]string{
+	"d":                    "d",
+	"type":                 "type",
+	"keywords":             "keywords",
+	"inLanguage":           "inLanguage",
+	"about":                "about.id",
+	"learningResourceType": "learningResourceType.id",
+	"audience":             "audience.id",
+	"teaches":              "teaches.id",
+	"assesses":             "assesses.id",
+	"competencyRequired":   "competencyRequired.id",
+	"educationalLevel":     "educationalLevel.id",
+	"interactivityType":    "interactivityType.id",
+	"conditionsOfAccess":   "conditionsOfAccess.id",
+	"license":              "license.id",
+	"creator":              "creator.id",
+	"contributor":          "contributor.id",
+	"publisher":            "publisher.id",
+	"funder":               "funder.id",
+	"isBasedOn":            "isBasedOn.id",
+	"isPartOf":             "isPartOf.id",
+	"hasPart":              "hasPart.id",
+}
+
+// unindexedTags returns the tag filters that have no indexed AMB counterpart
+func unindexedTags(filter nostr.Filter) nostr.TagMap {
+	unindexed := make(nostr.TagMap)
+	for tagName, values := range filter.Tags {
+		if _, ok := tagFields[tagName]; !ok {
+			unindexed[tagName] = values
 		}
+	}
+	return unindexed
+}
 
-		for _, value := range values {
-			// Create the filter expression
-			filterExpr := fmt.Sprintf("%s:%s", field, value)
-			
-			// Add to the corresponding field group
-			fieldGroups[baseName] = append(fieldGroups[baseName], filterExpr)
+// matchesTags checks that the event has a matching tag for every tag filter
+func matchesTags(event *nostr.Event, tags nostr.TagMap) bool {
+	for tagName, values := range tags {
+		if !event.Tags.ContainsAny(tagName, values) {
+			return false
 		}
 	}
+	return true
+}
+
+// nostrFilterExpressions translates the ids, authors, kinds, indexed tags and the
+// since/until time window of a nostr filter into Typesense filter_by expressions
+func nostrFilterExpressions(filter nostr.Filter) *FilterBuilder {
+	filterBy := &FilterBuilder{}
 
-	// Build the final filter expressions
-	var finalFilterExpressions []string
-
-	for _, expressions := range fieldGroups {
-		if len(expressions) == 1 {
-			// Single expression, add as is
-			finalFilterExpressions = append(finalFilterExpressions, expressions[0])
-		} else {
-			// Multiple expressions for same base field, join with OR
-			orExpression := fmt.Sprintf("(%s)", strings.Join(expressions, " || "))
-			finalFilterExpressions = append(finalFilterExpressions, orExpression)
+	filterBy.Equals("eventID", filter.IDs...)
+	filterBy.Equals("eventPubKey", filter.Authors...)
+	filterBy.EqualsInt("eventKind", filter.Kinds...)
+
+	// Sort the tag names so the resulting filter is deterministic
+	tagNames := make([]string, 0, len(filter.Tags))
+	for tagName := range filter.Tags {
+		if _, ok := tagFields[tagName]; ok {
+			tagNames = append(tagNames, tagName)
 		}
 	}
+	sort.Strings(tagNames)
 
-	// Combine all filter expressions with AND
-	if len(finalFilterExpressions) > 0 {
-		params["filter_by"] = strings.Join(finalFilterExpressions, " && ")
+	for _, tagName := range tagNames {
+		filterBy.Equals(tagFields[tagName], filter.Tags[tagName]...)
 	}
 
-	return mainQuery, params, nil
-}
+	if filter.Since != nil {
+		filterBy.Compare("eventCreatedAt", ">=", int64(*filter.Since))
+	}
 
-func parseSearchResponse(responseBody []byte) ([]nostr.Event, error) {
-	var searchResponse SearchResponse
-	if err := json.Unmarshal(responseBody, &searchResponse); err != nil {
-		return nil, fmt.Errorf("error parsing search response: %v", err)
+	if filter.Until != nil {
+		filterBy.Compare("eventCreatedAt", "<=", int64(*filter.Until))
 	}
 
-	// Debug: Print the raw response structure
-	fmt.Printf("Search response found %d hits\n", searchResponse.Found)
-	
-	nostrResults := make([]nostr.Event, 0, len(searchResponse.Hits))
-
-	for i, hit := range searchResponse.Hits {
-		// Debug: Print hit structure information
-		fmt.Printf("Processing hit %d, keys: %v\n", i, getMapKeys(hit))
-		
-		// Check if document exists in the hit
-		docRaw, exists := hit["document"]
-		if !exists {
-			fmt.Printf("Warning: hit %d has no 'document' field\n", i)
-			continue // Skip this hit
-		}
-		
-		// Extract document directly as a map[string]interface{}
-		docMap, ok := docRaw.(map[string]interface{})
+	return filterBy
+}
+
+// eventsFromHits converts the eventRaw of every search hit back into a Nostr event.
+// Hits without a usable eventRaw are skipped.
+func (ts *TSBackend) eventsFromHits(ctx context.Context, hits []map[string]any) []nostr.Event {
+	ctx, span := ts.startSpan(ctx, "typesense.DecodeEvents", attribute.Int("typesense.hits", len(hits)))
+	defer span.End()
+
+	logger := ts.logger()
+	nostrResults := make([]nostr.Event, 0, len(hits))
+
+	for i, hit := range hits {
+		docMap, ok := hit["document"].(map[string]any)
 		if !ok {
-			fmt.Printf("Warning: hit %d document is not a map, type: %T\n", i, docRaw)
-			continue // Skip this hit
-		}
-		
-		// Debug: Print document keys
-		fmt.Printf("Document keys: %v\n", getMapKeys(docMap))
-		
-		// Check for EventRaw field directly
-		eventRawVal, hasEventRaw := docMap["eventRaw"]
-		if !hasEventRaw {
-			fmt.Printf("Warning: document has no 'eventRaw' field\n")
-			continue // Skip this document
+			ts.metrics().CountSkippedDocument(SkipMissingDocument)
+			logger.WarnContext(ctx, "skipping search hit without document", "hit", i)
+			continue
 		}
-		
-		// Try to extract EventRaw as string
-		eventRawStr, ok := eventRawVal.(string)
+
+		documentID, _ := docMap["id"].(string)
+		eventRawStr, ok := docMap["eventRaw"].(string)
 		if !ok {
-			fmt.Printf("Warning: eventRaw is not a string, type: %T\n", eventRawVal)
-			continue // Skip this document
+			ts.metrics().CountSkippedDocument(SkipMissingEventRaw)
+			logger.WarnContext(ctx, "skipping document without eventRaw", "hit", i, "document_id", documentID)
+			continue
 		}
-		
+
 		// Convert the EventRaw string to a Nostr event
 		nostrEvent, err := StringifiedJSONToNostrEvent(eventRawStr)
 		if err != nil {
-			fmt.Printf("Warning: failed to convert EventRaw to Nostr event: %v\n", err)
+			ts.metrics().CountSkippedDocument(SkipInvalidEventRaw)
+			logger.WarnContext(ctx, "skipping document with unparsable eventRaw", "hit", i, "document_id", documentID, "error", err)
 			continue
 		}
 
+		logger.DebugContext(ctx, "search hit", eventAttrs(&nostrEvent)...)
 		nostrResults = append(nostrResults, nostrEvent)
 	}
 
-	// Print the number of results for logging
-	fmt.Printf("Successfully processed %d results\n", len(nostrResults))
-
-	return nostrResults, nil
+	span.SetAttributes(attrResultCount.Int(len(nostrResults)))
+	return nostrResults
 }
 
-// Helper function to get keys from a map for debugging
-func getMapKeys(m map[string]interface{}) []string {
-	keys := make([]string, 0, len(m))
-	for k := range m {
-		keys = append(keys, k)
+// eventAttrs describes an event in log records
+func eventAttrs(event *nostr.Event) []any {
+	return []any{
+		slog.String("event_id", event.ID),
+		slog.String("pubkey", event.PubKey),
+		slog.Int("kind", event.Kind),
+		slog.String("d", event.Tags.GetD()),
 	}
-	return keys
 }
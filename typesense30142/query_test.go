@@ -1,2 +1,218 @@
 package typesense30142
 
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNostrFilterExpressions(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := nostr.Filter{
+		IDs:     []string{"id1", "id2"},
+		Authors: []string{"pubkey1"},
+		Kinds:   []int{30142, 1},
+	}
+
+	expressions := nostrFilterExpressions(filter)
+
+	assert.Equal("eventID:=[`id1`,`id2`] && eventPubKey:=`pubkey1` && eventKind:=[30142,1]", expressions.String())
+}
+
+func TestNostrFilterExpressions_Empty(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(nostrFilterExpressions(nostr.Filter{Search: "Französisch"}).Empty())
+}
+
+func TestNostrFilterExpressions_TimeWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	since := nostr.Timestamp(1700000000)
+	until := nostr.Timestamp(1710000000)
+	filter := nostr.Filter{
+		Kinds: []int{30142},
+		Since: &since,
+		Until: &until,
+	}
+
+	expressions := nostrFilterExpressions(filter)
+
+	assert.Equal("eventKind:=[30142] && eventCreatedAt:>=1700000000 && eventCreatedAt:<=1710000000", expressions.String())
+}
+
+func TestNostrFilterExpressions_Tags(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := nostr.Filter{
+		Kinds: []int{30142},
+		Tags: nostr.TagMap{
+			"d":        []string{"resource-1"},
+			"about":    []string{"http://w3id.org/kim/schulfaecher/s1009"},
+			"keywords": []string{"Französisch", "Sprache"},
+			"t":        []string{"unindexed"},
+		},
+	}
+
+	expressions := nostrFilterExpressions(filter)
+
+	assert.Equal("eventKind:=[30142] && about.id:=`http://w3id.org/kim/schulfaecher/s1009` && d:=`resource-1` && keywords:=[`Französisch`,`Sprache`]", expressions.String())
+	assert.Equal(nostr.TagMap{"t": []string{"unindexed"}}, unindexedTags(filter))
+}
+
+func TestMatchesTags(t *testing.T) {
+	assert := assert.New(t)
+
+	event := createTestEvent(nostr.Tags{
+		{"d", "resource-1"},
+		{"t", "chemistry"},
+	})
+
+	assert.True(matchesTags(event, nostr.TagMap{"t": []string{"physics", "chemistry"}}))
+	assert.False(matchesTags(event, nostr.TagMap{"t": []string{"physics"}}))
+	assert.False(matchesTags(event, nostr.TagMap{"r": []string{"chemistry"}}))
+}
+
+func TestQueryLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := &TSBackend{MaxLimit: 500}
+
+	assert.Equal(500, ts.queryLimit(nostr.Filter{}))
+	assert.Equal(20, ts.queryLimit(nostr.Filter{Limit: 20}))
+	assert.Equal(500, ts.queryLimit(nostr.Filter{Limit: 5000}))
+	assert.Equal(0, ts.queryLimit(nostr.Filter{LimitZero: true}))
+	assert.Equal(defaultMaxLimit, (&TSBackend{}).queryLimit(nostr.Filter{}))
+}
+
+func TestQueryEvents_Paging(t *testing.T) {
+	assert := assert.New(t)
+
+	// 600 documents spread over pages of at most 250 hits
+	const total = 600
+	var requestedPages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		requestedPages = append(requestedPages, r.URL.Query().Get("page"))
+
+		hits := []map[string]any{}
+		for i := (page - 1) * perPage; i < min(page*perPage, total); i++ {
+			event := createTestEvent(nostr.Tags{{"d", fmt.Sprintf("resource-%d", i)}})
+			raw, _ := eventToStringifiedJSON(event)
+			hits = append(hits, map[string]any{"document": map[string]any{"eventRaw": raw}})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"found": total, "page": page, "hits": hits})
+	}))
+	defer server.Close()
+
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	ch, err := ts.QueryEvents(context.Background(), nostr.Filter{Limit: 300})
+	assert.NoError(err)
+
+	received := 0
+	for range ch {
+		received++
+	}
+
+	assert.Equal(300, received)
+	assert.Equal([]string{"1", "2"}, requestedPages)
+
+	events, err := ts.SearchResources(context.Background(), nostr.Filter{})
+	assert.NoError(err)
+	assert.Len(events, total)
+}
+
+func TestQueryEvents_ScanLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	// 1000 documents, only the first has the tag without an indexed field
+	const total = 1000
+	hits := make([]map[string]any, total)
+	for i := range hits {
+		tags := nostr.Tags{{"d", fmt.Sprintf("resource-%d", i)}}
+		if i == 0 {
+			tags = append(tags, nostr.Tag{"e", "x"})
+		}
+		raw, _ := eventToStringifiedJSON(createTestEvent(tags))
+		hits[i] = map[string]any{"document": map[string]any{"eventRaw": raw}}
+	}
+	var requestedPages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		requestedPages = append(requestedPages, r.URL.Query().Get("page"))
+		json.NewEncoder(w).Encode(map[string]any{"found": total, "page": page, "hits": hits[(page-1)*perPage : min(page*perPage, total)]})
+	}))
+	defer server.Close()
+
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", MaxScannedHits: 500}
+	filter := nostr.Filter{Tags: nostr.TagMap{"e": []string{"x"}}}
+
+	events, err := ts.SearchResources(context.Background(), filter)
+	assert.NoError(err)
+	assert.Len(events, 1)
+	assert.Equal([]string{"1", "2"}, requestedPages)
+
+	// A count can't be cut off without being wrong
+	_, err = ts.CountEvents(context.Background(), filter)
+	assert.ErrorIs(err, ErrScanLimit)
+
+	ts.MaxScannedHits = total
+	count, err := ts.CountEvents(context.Background(), filter)
+	assert.NoError(err)
+	assert.Equal(int64(1), count)
+}
+
+func TestEventsFromHits_LogsSkippedDocuments(t *testing.T) {
+	assert := assert.New(t)
+
+	var logs bytes.Buffer
+	ts := &TSBackend{Logger: slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn}))}
+
+	event := createTestEvent(nostr.Tags{{"d", "resource-1"}})
+	raw, _ := eventToStringifiedJSON(event)
+	hits := []map[string]any{
+		{"document": map[string]any{"id": "valid", "eventRaw": raw}},
+		{"document": map[string]any{"id": "missing"}},
+		{"document": map[string]any{"id": "broken", "eventRaw": "{"}},
+	}
+
+	events := ts.eventsFromHits(context.Background(), hits)
+	assert.Len(events, 1)
+
+	var records []map[string]any
+	decoder := json.NewDecoder(&logs)
+	for decoder.More() {
+		var record map[string]any
+		assert.NoError(decoder.Decode(&record))
+		records = append(records, record)
+	}
+
+	if assert.Len(records, 2) {
+		assert.Equal("WARN", records[0]["level"])
+		assert.Equal("missing", records[0]["document_id"])
+		assert.Equal("broken", records[1]["document_id"])
+		assert.Contains(records[1], "error")
+	}
+}
+
+func TestEventsFromHits_DefaultLoggerIsSilent(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := &TSBackend{}
+
+	assert.Empty(ts.eventsFromHits(context.Background(), []map[string]any{{"document": map[string]any{}}}))
+	assert.Same(discardLogger, ts.logger())
+}
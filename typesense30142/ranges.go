@@ -0,0 +1,218 @@
+package typesense30142
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rangeField is an AMB field that can be searched by range through a numeric
+// shadow field
+type rangeField struct {
+	// shadow is the name of the numeric field holding the normalized value
+	shadow string
+	// parse returns the first and last second covered by a value of the field
+	parse func(value string) (int64, int64, error)
+}
+
+// rangeFields maps the AMB fields searchable by range to their shadow fields
+var rangeFields = map[string]rangeField{
+	"dateCreated":   {shadow: "dateCreatedTimestamp", parse: parseDate},
+	"datePublished": {shadow: "datePublishedTimestamp", parse: parseDate},
+	"dateModified":  {shadow: "dateModifiedTimestamp", parse: parseDate},
+	"duration":      {shadow: "durationSeconds", parse: parseDurationRange},
+}
+
+// shadowFields are the fields filled by setShadowFields
+var shadowFields = []string{"nameSort", "dateCreatedTimestamp", "datePublishedTimestamp", "dateModifiedTimestamp", "durationSeconds"}
+
+// setShadowFields fills the fields derived for searching and sorting: the
+// numeric shadows of the dates and the duration, and the sort key of the name.
+// Values that can't be parsed are left out of range searches.
+func (amb *AMBMetadata) setShadowFields() {
+	amb.NameSort = sortKey(amb.Name)
+	amb.DateCreatedTimestamp = shadowValue(amb.DateCreated, parseDate)
+	amb.DatePublishedTimestamp = shadowValue(amb.DatePublished, parseDate)
+	amb.DateModifiedTimestamp = shadowValue(amb.DateModified, parseDate)
+	amb.DurationSeconds = shadowValue(amb.Duration, parseDurationRange)
+}
+
+func shadowValue(value string, parse func(string) (int64, int64, error)) *int64 {
+	if value == "" {
+		return nil
+	}
+
+	first, _, err := parse(value)
+	if err != nil {
+		return nil
+	}
+	return &first
+}
+
+// dateLayouts are the ISO-8601 date formats found in AMB metadata, from the most
+// to the least precise. Dates without a time zone are taken as UTC.
+var dateLayouts = []struct {
+	layout string
+	// period is the length of the time span a date in this layout stands for
+	period func(time.Time) time.Time
+}{
+	{layout: time.RFC3339Nano, period: func(t time.Time) time.Time { return t }},
+	{layout: "2006-01-02T15:04:05", period: func(t time.Time) time.Time { return t }},
+	{layout: "2006-01-02T15:04", period: func(t time.Time) time.Time { return t.Add(time.Minute - time.Second) }},
+	{layout: "2006-01-02", period: func(t time.Time) time.Time { return t.AddDate(0, 0, 1).Add(-time.Second) }},
+	{layout: "2006-01", period: func(t time.Time) time.Time { return t.AddDate(0, 1, 0).Add(-time.Second) }},
+	{layout: "2006", period: func(t time.Time) time.Time { return t.AddDate(1, 0, 0).Add(-time.Second) }},
+}
+
+// parseDate returns the epoch seconds of the first and last second of an
+// ISO-8601 date, e.g. 2023-01-01 covers the whole day and 2023 the whole year
+func parseDate(value string) (int64, int64, error) {
+	for _, format := range dateLayouts {
+		t, err := time.Parse(format.layout, value)
+		if err == nil {
+			return t.Unix(), format.period(t).Unix(), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid date %q", value)
+}
+
+// durationPattern matches ISO-8601 durations like P1DT2H or PT30M
+var durationPattern = regexp.MustCompile(`^P(?:(\d+(?:[.,]\d+)?)Y)?(?:(\d+(?:[.,]\d+)?)M)?(?:(\d+(?:[.,]\d+)?)W)?(?:(\d+(?:[.,]\d+)?)D)?(?:T(?:(\d+(?:[.,]\d+)?)H)?(?:(\d+(?:[.,]\d+)?)M)?(?:(\d+(?:[.,]\d+)?)S)?)?$`)
+
+// durationUnits are the seconds of the units of durationPattern, years and
+// months are approximated with 365 and 30 days
+var durationUnits = []float64{365 * 86400, 30 * 86400, 7 * 86400, 86400, 3600, 60, 1}
+
+// parseDuration returns the total seconds of an ISO-8601 duration
+func parseDuration(value string) (int64, error) {
+	match := durationPattern.FindStringSubmatch(value)
+	if match == nil || strings.HasSuffix(value, "T") || value == "P" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+
+	var seconds float64
+	for i, unit := range durationUnits {
+		if match[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.Replace(match[i+1], ",", ".", 1), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q: %v", value, err)
+		}
+		seconds += n * unit
+	}
+
+	return int64(math.Round(seconds)), nil
+}
+
+// parseDurationRange is parseDuration for rangeFields, a duration covers a single second
+func parseDurationRange(value string) (int64, int64, error) {
+	seconds, err := parseDuration(value)
+	return seconds, seconds, err
+}
+
+// isRangeValue reports whether the value of a field filter is a range. Only
+// the rangeFields have ranges, on all other fields values like <html> or
+// relative URLs are matched as they are.
+func isRangeValue(field string, value string) bool {
+	if _, ok := rangeFields[field]; !ok {
+		return false
+	}
+	return strings.HasPrefix(value, ">") || strings.HasPrefix(value, "<") || strings.Contains(value, "..")
+}
+
+// parseRange translates a range on one of the rangeFields into a rangeNode on
+// its shadow field. The bounds cover whole periods, e.g. datePublished:<=2023
+// includes the last day of 2023 and datePublished:>2023 starts with 2024.
+func parseRange(t token) (searchNode, error) {
+	field := rangeFields[t.text]
+	node := &rangeNode{field: field.shadow, pos: t.offset}
+	bound := func(value string) (int64, int64, error) {
+		first, last, err := field.parse(value)
+		if err != nil {
+			return 0, 0, syntaxError(t.offset, "%s: %v", t.text, err)
+		}
+		return first, last, nil
+	}
+
+	value := t.value
+	switch {
+	case strings.HasPrefix(value, ">="):
+		first, _, err := bound(value[2:])
+		if err != nil {
+			return nil, err
+		}
+		node.lower = &first
+
+	case strings.HasPrefix(value, ">"):
+		_, last, err := bound(value[1:])
+		if err != nil {
+			return nil, err
+		}
+		last++
+		node.lower = &last
+
+	case strings.HasPrefix(value, "<="):
+		_, last, err := bound(value[2:])
+		if err != nil {
+			return nil, err
+		}
+		node.upper = &last
+
+	case strings.HasPrefix(value, "<"):
+		first, _, err := bound(value[1:])
+		if err != nil {
+			return nil, err
+		}
+		first--
+		node.upper = &first
+
+	default:
+		from, to, _ := strings.Cut(value, "..")
+		if from == "" && to == "" {
+			return nil, syntaxError(t.offset, "%s: range without bounds", t.text)
+		}
+		if from != "" {
+			first, _, err := bound(from)
+			if err != nil {
+				return nil, err
+			}
+			node.lower = &first
+		}
+		if to != "" {
+			_, last, err := bound(to)
+			if err != nil {
+				return nil, err
+			}
+			node.upper = &last
+		}
+		if node.lower != nil && node.upper != nil && *node.lower > *node.upper {
+			return nil, syntaxError(t.offset, "%s: range %s ends before it starts", t.text, value)
+		}
+	}
+
+	return node, nil
+}
+
+// filterExpression translates the range into a filter_by expression. Negated
+// ranges match the values outside of the range, documents without the field
+// match neither.
+func (n *rangeNode) filterExpression(negated bool) string {
+	switch {
+	case n.lower != nil && n.upper != nil && negated:
+		return fmt.Sprintf("(%s:<%d || %s:>%d)", n.field, *n.lower, n.field, *n.upper)
+	case n.lower != nil && n.upper != nil:
+		return fmt.Sprintf("%s:[%d..%d]", n.field, *n.lower, *n.upper)
+	case n.lower != nil && negated:
+		return fmt.Sprintf("%s:<%d", n.field, *n.lower)
+	case n.lower != nil:
+		return fmt.Sprintf("%s:>=%d", n.field, *n.lower)
+	case negated:
+		return fmt.Sprintf("%s:>%d", n.field, *n.upper)
+	default:
+		return fmt.Sprintf("%s:<=%d", n.field, *n.upper)
+	}
+}
@@ -0,0 +1,95 @@
+package typesense30142
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDate(t *testing.T) {
+	testCases := []struct {
+		value string
+		first int64
+		last  int64
+	}{
+		{value: "2023-01-01T10:30:00Z", first: 1672569000, last: 1672569000},
+		{value: "2023-01-01T12:30:00+02:00", first: 1672569000, last: 1672569000},
+		{value: "2023-01-01T10:30", first: 1672569000, last: 1672569059},
+		{value: "2023-01-01", first: 1672531200, last: 1672617599},
+		{value: "2023-02", first: 1675209600, last: 1677628799},
+		{value: "2023", first: 1672531200, last: 1704067199},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			assert := assert.New(t)
+
+			first, last, err := parseDate(tc.value)
+			assert.NoError(err)
+			assert.Equal(tc.first, first)
+			assert.Equal(tc.last, last)
+		})
+	}
+
+	for _, value := range []string{"", "01.01.2023", "2023-13-01", "yesterday"} {
+		_, _, err := parseDate(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	testCases := map[string]int64{
+		"PT30M":     1800,
+		"PT1H30M":   5400,
+		"PT1.5H":    5400,
+		"PT0,5S":    1,
+		"P1DT2H":    93600,
+		"P2W":       1209600,
+		"P1Y2M":     36720000,
+		"PT45S":     45,
+		"P0D":       0,
+		"PT1H0M10S": 3610,
+	}
+
+	for value, seconds := range testCases {
+		t.Run(value, func(t *testing.T) {
+			assert := assert.New(t)
+
+			parsed, err := parseDuration(value)
+			assert.NoError(err)
+			assert.Equal(seconds, parsed)
+		})
+	}
+
+	for _, value := range []string{"", "P", "PT", "P1DT", "30M", "PT30", "1 hour", "PT-5M"} {
+		_, err := parseDuration(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestNostrToAMB_ShadowFields(t *testing.T) {
+	assert := assert.New(t)
+
+	amb, err := NostrToAMB(createTestEvent(nostr.Tags{
+		{"d", "resource-1"},
+		{"name", "Übungen zur Bruchrechnung"},
+		{"datePublished", "2023-01-01"},
+		{"dateModified", "2024-03-01T08:00:00Z"},
+		{"dateCreated", "not a date"},
+		{"duration", "PT30M"},
+	}))
+	assert.NoError(err)
+
+	assert.Equal("ubungen zur bruchrechnung", amb.NameSort)
+	if assert.NotNil(amb.DatePublishedTimestamp) {
+		assert.Equal(int64(1672531200), *amb.DatePublishedTimestamp)
+	}
+	if assert.NotNil(amb.DateModifiedTimestamp) {
+		assert.Equal(int64(1709280000), *amb.DateModifiedTimestamp)
+	}
+	assert.Nil(amb.DateCreatedTimestamp)
+	if assert.NotNil(amb.DurationSeconds) {
+		assert.Equal(int64(1800), *amb.DurationSeconds)
+	}
+}
@@ -0,0 +1,404 @@
+package typesense30142
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+)
+
+// importBatchSize is the number of documents sent with a single import request
+const importBatchSize = 100
+
+// exportedEvent is the part of an AMB document needed to rebuild it
+type exportedEvent struct {
+	ID       string `json:"id"`
+	EventID  string `json:"eventID"`
+	EventRaw string `json:"eventRaw"`
+}
+
+// Reindex rebuilds the AMB collection from the stored events without
+// interrupting searches. It creates a new versioned collection with the current
+// schema, converts the eventRaw of every document again, and then points the
+// CollectionName alias to the new collection in a single step. Events written
+// while the copy was running are applied to the new collection afterwards.
+//
+// Collections created before CollectionName became an alias keep serving until
+// they are dropped, since Typesense resolves a collection before an alias of the
+// same name. The alias is created first, dropping the collection then switches
+// to the new one. Writes between the last export of the old collection and the
+// drop are lost. If the drop fails, the next Reindex starts over from the old
+// collection, if creating the alias fails, the old collection is kept.
+//
+// The exports of the old collection are streamed and limited by ReindexTimeout.
+func (ts *TSBackend) Reindex(ctx context.Context) (err error) {
+	ctx, span := ts.startSpan(ctx, "typesense.Reindex")
+	defer func() { endSpan(span, err) }()
+
+	current, err := ts.getAlias(ctx, ts.CollectionName)
+	if err != nil {
+		return fmt.Errorf("error resolving alias %s: %w", ts.CollectionName, err)
+	}
+	// A legacy collection left over by a Reindex that failed to drop it still
+	// serves in place of the alias, so it is the one to copy
+	legacy, err := ts.legacyCollection(ctx)
+	if err != nil {
+		return err
+	}
+	aliased := current != "" && legacy == nil
+	if !aliased {
+		current = ts.CollectionName
+	}
+
+	next, err := ts.nextCollectionVersion(ctx, current)
+	if err != nil {
+		return err
+	}
+
+	schema, err := ts.collectionSchema(next)
+	if err != nil {
+		return err
+	}
+	if err := ts.createCollection(ctx, schema); err != nil {
+		return fmt.Errorf("error creating collection %s: %w", next, err)
+	}
+
+	copied, err := ts.copyEvents(ctx, current, next)
+	if err != nil {
+		if dropErr := ts.dropCollection(ctx, next); dropErr != nil {
+			ts.logger().ErrorContext(ctx, "failed to drop incomplete collection", "collection", next, "error", dropErr)
+		}
+		return err
+	}
+
+	// The old collection doesn't receive writes anymore once the alias points
+	// to the new one, its last state tells which events changed in the meantime
+	var changed []exportedEvent
+	var removed map[string]string
+	if aliased {
+		if err := ts.putAlias(ctx, ts.CollectionName, next); err != nil {
+			return err
+		}
+		if changed, removed, err = ts.changedEvents(ctx, current, copied); err != nil {
+			return err
+		}
+	} else {
+		// Typesense resolves the collection before the alias of the same name,
+		// so the old collection keeps serving until it is dropped
+		if err := ts.putAlias(ctx, ts.CollectionName, next); err != nil {
+			return err
+		}
+		if changed, removed, err = ts.changedEvents(ctx, current, copied); err != nil {
+			return err
+		}
+		if err := ts.dropCollection(ctx, current); err != nil {
+			return err
+		}
+	}
+
+	if err := ts.applyChanges(ctx, changed, removed); err != nil {
+		return err
+	}
+
+	if aliased && ts.DropOldCollection {
+		if err := ts.dropCollection(ctx, current); err != nil {
+			return err
+		}
+	}
+
+	span.SetAttributes(attrResultCount.Int(len(copied)))
+	ts.logger().InfoContext(ctx, "reindexed collection", "from", current, "to", next, "documents", len(copied))
+
+	return nil
+}
+
+// nextCollectionVersion returns the name of the next unused versioned
+// collection of CollectionName, e.g. amb_v2 after amb_v1
+func (ts *TSBackend) nextCollectionVersion(ctx context.Context, current string) (string, error) {
+	for version := ts.collectionVersion(current) + 1; ; version++ {
+		name := ts.CollectionName + "_v" + strconv.Itoa(version)
+		live, err := ts.getCollection(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("error checking collection %s: %w", name, err)
+		}
+		if live == nil {
+			return name, nil
+		}
+	}
+}
+
+// collectionVersion returns N of a versioned collection <CollectionName>_vN
+// and 0 for any other collection
+func (ts *TSBackend) collectionVersion(name string) int {
+	suffix, ok := strings.CutPrefix(name, ts.CollectionName+"_v")
+	if !ok {
+		return 0
+	}
+	version, err := strconv.Atoi(suffix)
+	if err != nil || version < 1 {
+		return 0
+	}
+	return version
+}
+
+// copyEvents converts the events stored in one collection into documents of
+// another batch by batch and returns the event ids of the copied documents by
+// document id
+func (ts *TSBackend) copyEvents(ctx context.Context, from string, to string) (map[string]string, error) {
+	copied := map[string]string{}
+	batch := make([]*AMBMetadata, 0, importBatchSize)
+
+	err := ts.exportEvents(ctx, from, func(stored exportedEvent) error {
+		copied[stored.ID] = stored.EventID
+
+		doc, err := exportedDocument(stored)
+		if err != nil {
+			ts.metrics().CountSkippedDocument(SkipInvalidEventRaw)
+			ts.logger().WarnContext(ctx, "skipping document during reindex", "document_id", stored.ID, "error", err)
+			return nil
+		}
+
+		batch = append(batch, doc)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		err = ts.importDocuments(ctx, to, batch)
+		batch = batch[:0]
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(batch) > 0 {
+		if err := ts.importDocuments(ctx, to, batch); err != nil {
+			return nil, err
+		}
+	}
+
+	return copied, nil
+}
+
+// changedEvents compares the current state of a collection with the copied
+// documents. It returns the events that were added or replaced since and the
+// event ids of the removed documents by document id.
+func (ts *TSBackend) changedEvents(ctx context.Context, collection string, copied map[string]string) ([]exportedEvent, map[string]string, error) {
+	changed := []exportedEvent{}
+	removed := maps.Clone(copied)
+
+	err := ts.exportEvents(ctx, collection, func(stored exportedEvent) error {
+		delete(removed, stored.ID)
+		if eventID, ok := copied[stored.ID]; !ok || eventID != stored.EventID {
+			changed = append(changed, stored)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return changed, removed, nil
+}
+
+// applyChanges brings the collection behind the alias up to date with the
+// writes that reached the old collection after it was copied
+func (ts *TSBackend) applyChanges(ctx context.Context, changed []exportedEvent, removed map[string]string) error {
+	for _, stored := range changed {
+		event, err := StringifiedJSONToNostrEvent(stored.EventRaw)
+		if err != nil {
+			ts.logger().WarnContext(ctx, "skipping document during reindex", "document_id", stored.ID, "error", err)
+			continue
+		}
+
+		err = ts.SaveEvent(ctx, &event)
+		if err != nil && !errors.Is(err, eventstore.ErrDupEvent) && !errors.Is(err, ErrOlderEvent) && !errors.Is(err, ErrTombstoned) {
+			return err
+		}
+	}
+
+	for id, eventID := range removed {
+		// Deleted from the old collection while it was copied. Only the copied
+		// event is deleted, the document may have been republished since the
+		// alias points to the new collection. The new document id can differ
+		// from the old one, legacy collections stored events under their id.
+		filterBy := (&FilterBuilder{}).Equals("eventID", eventID)
+		if _, err := ts.deleteByFilter(ctx, filterBy); err != nil {
+			return fmt.Errorf("error deleting document %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// exportedDocument converts the stored event back into an AMB document
+func exportedDocument(stored exportedEvent) (*AMBMetadata, error) {
+	event, err := StringifiedJSONToNostrEvent(stored.EventRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	return eventToDocument(&event)
+}
+
+// exportEvents hands the stored events of a collection to fn one by one
+func (ts *TSBackend) exportEvents(ctx context.Context, collection string, fn func(stored exportedEvent) error) error {
+	params := url.Values{"include_fields": {"id,eventID,eventRaw"}}
+
+	return ts.exportDocuments(ctx, opReindex, collection, params, func(line []byte) error {
+		var stored exportedEvent
+		if err := json.Unmarshal(line, &stored); err != nil {
+			return fmt.Errorf("error parsing document: %v", err)
+		}
+		return fn(stored)
+	})
+}
+
+// maxExportLine limits the size of a single exported document
+const maxExportLine = 64 << 20
+
+// exportDocuments streams every document of the collection to fn as a line of
+// JSON, the line is only valid until fn returns
+func (ts *TSBackend) exportDocuments(ctx context.Context, op operation, collection string, params url.Values, fn func(line []byte) error) error {
+	path := ts.collectionDocumentsPath(collection, "/export", params)
+
+	resp, body, err := ts.streamRequest(ctx, op, path, http.MethodGet)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to export %s: %w", collection, newTypesenseError(resp, body))
+	}
+	defer resp.Body.Close()
+
+	// The export is a JSON document per line
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, maxExportLine)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// importDocuments upserts the documents into the collection with a single request.
+// Documents refused by Typesense are logged and skipped.
+func (ts *TSBackend) importDocuments(ctx context.Context, collection string, docs []*AMBMetadata) error {
+	var lines bytes.Buffer
+	for _, doc := range docs {
+		jsonData, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		lines.Write(jsonData)
+		lines.WriteByte('\n')
+	}
+
+	path := ts.collectionDocumentsPath(collection, "/import", url.Values{"action": {"upsert"}})
+	resp, body, err := ts.makehttpRequest(ctx, opUpsert, path, http.MethodPost, lines.Bytes())
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to import documents: %w", newTypesenseError(resp, body))
+	}
+
+	// The response has a result per line in the order of the documents
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for i := 0; scanner.Scan(); i++ {
+		var result struct {
+			Success bool   `json:"success"`
+			Error   string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			return fmt.Errorf("error parsing import response: %v", err)
+		}
+		if !result.Success && i < len(docs) {
+			ts.logger().WarnContext(ctx, "document refused during import",
+				"collection", collection, "document_id", docs[i].ID, "error", result.Error)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// getAlias returns the collection an alias points to or "" if there is no such alias
+func (ts *TSBackend) getAlias(ctx context.Context, name string) (string, error) {
+	path := "/aliases/" + url.PathEscape(name)
+
+	resp, body, err := ts.makehttpRequest(ctx, opCollection, path, http.MethodGet, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newTypesenseError(resp, body)
+	}
+
+	var alias struct {
+		CollectionName string `json:"collection_name"`
+	}
+	if err := json.Unmarshal(body, &alias); err != nil {
+		return "", fmt.Errorf("error parsing alias %s: %v", name, err)
+	}
+
+	return alias.CollectionName, nil
+}
+
+// putAlias creates an alias or points an existing one to another collection
+func (ts *TSBackend) putAlias(ctx context.Context, name string, collection string) error {
+	path := "/aliases/" + url.PathEscape(name)
+
+	jsonData, err := json.Marshal(map[string]string{"collection_name": collection})
+	if err != nil {
+		return err
+	}
+
+	resp, body, err := ts.makehttpRequest(ctx, opCollection, path, http.MethodPut, jsonData)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to point alias %s to %s: %w", name, collection, newTypesenseError(resp, body))
+	}
+
+	return nil
+}
+
+// dropCollection deletes a collection with all its documents
+func (ts *TSBackend) dropCollection(ctx context.Context, name string) error {
+	path := "/collections/" + url.PathEscape(name)
+
+	resp, body, err := ts.makehttpRequest(ctx, opCollection, path, http.MethodDelete, nil)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to drop collection %s: %w", name, newTypesenseError(resp, body))
+	}
+
+	return nil
+}
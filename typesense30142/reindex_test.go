@@ -0,0 +1,206 @@
+package typesense30142
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReindex_LegacyCollection(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	ctx := context.Background()
+
+	// Legacy collections store the documents under their event id
+	event := createTestEvent(nostr.Tags{{"d", "resource-1"}, {"name", "Bruchrechnung"}})
+	other := createTestEvent(nostr.Tags{{"d", "resource-2"}})
+	deleted := createTestEvent(nostr.Tags{{"d", "resource-3"}})
+	for _, e := range []*nostr.Event{event, other, deleted} {
+		fake.collection("amb")[e.ID] = legacyDocument(e)
+	}
+
+	// A document indexed by an older mapping, it is rebuilt from its eventRaw
+	var doc map[string]any
+	json.Unmarshal(fake.collection("amb")[event.ID], &doc)
+	doc["name"] = "outdated"
+	fake.collection("amb")[event.ID], _ = json.Marshal(doc)
+
+	// One of the events is deleted while it is copied
+	fake.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		switch {
+		case r.URL.Path == "/collections/amb_v1/documents/import":
+			delete(fake.collections["amb"], deleted.ID)
+		case r.Method == http.MethodDelete && r.URL.Path == "/collections/amb":
+			assert.Equal("amb_v1", fake.aliases["amb"], "alias created before the drop")
+		}
+		fake.mu.Unlock()
+		fake.handle(w, r)
+	})
+
+	assert.NoError(ts.Reindex(ctx))
+
+	assert.Equal("amb_v1", fake.aliases["amb"])
+	assert.NotContains(fake.collections, "amb")
+	documents := fake.collection("amb_v1")
+	assert.Len(documents, 2)
+	assert.Contains(documents, documentID(event))
+	assert.Contains(documents, documentID(other))
+	assert.Equal("Bruchrechnung", fake.document(documentID(event)).Name)
+}
+
+func TestReindex_LegacyCollectionNotDropped(t *testing.T) {
+	assert := assert.New(t)
+
+	// A Reindex created the alias but failed to drop the legacy collection,
+	// which still serves in place of the alias
+	fake := newFakeTypesense(t)
+	fake.aliases["amb"] = "amb_v1"
+	fake.collection("amb_v1")
+	event := createTestEvent(nostr.Tags{{"d", "resource-1"}})
+	fake.collections["amb"] = map[string]json.RawMessage{event.ID: legacyDocument(event)}
+	ts := fake.backend()
+
+	assert.NoError(ts.Init())
+	assert.NoError(ts.Reindex(context.Background()))
+
+	assert.Equal("amb_v2", fake.aliases["amb"])
+	assert.NotContains(fake.collections, "amb")
+	assert.Contains(fake.collection("amb"), documentID(event))
+}
+
+func TestReindex_SwapsAlias(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	fake.aliases["amb"] = "amb_v1"
+	ts := fake.backend()
+	ctx := context.Background()
+
+	assert.NoError(ts.SaveEvent(ctx, createTestEvent(nostr.Tags{{"d", "resource-1"}})))
+	assert.Len(fake.collections["amb_v1"], 1)
+
+	assert.NoError(ts.Reindex(ctx))
+
+	assert.Equal("amb_v2", fake.aliases["amb"])
+	assert.Len(fake.collections["amb_v2"], 1)
+	assert.Len(fake.collections["amb_v1"], 1, "kept without DropOldCollection")
+
+	ts.DropOldCollection = true
+	assert.NoError(ts.Reindex(ctx))
+
+	assert.Equal("amb_v3", fake.aliases["amb"])
+	assert.Len(fake.collections["amb_v3"], 1)
+	assert.NotContains(fake.collections, "amb_v2")
+}
+
+func TestReindex_SkipsInvalidEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	metrics := newRecordingMetrics()
+	ts := fake.backend()
+	ts.Metrics = metrics
+	ctx := context.Background()
+
+	assert.NoError(ts.SaveEvent(ctx, createTestEvent(nostr.Tags{{"d", "resource-1"}})))
+	fake.collection("amb")["broken"] = json.RawMessage(`{"id": "broken", "eventID": "broken", "eventRaw": "{"}`)
+
+	assert.NoError(ts.Reindex(ctx))
+
+	assert.Len(fake.collection("amb_v1"), 1)
+	assert.Equal(1, metrics.skipped[SkipInvalidEventRaw])
+}
+
+func TestApplyChanges(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	fake.aliases["amb"] = "amb_v1"
+	ts := fake.backend()
+	ctx := context.Background()
+
+	kept := createTestEvent(nostr.Tags{{"d", "kept"}})
+	deleted := createTestEvent(nostr.Tags{{"d", "deleted"}})
+	added := createTestEvent(nostr.Tags{{"d", "added"}})
+
+	// Between copying and swapping the alias, one event was deleted and one was added
+	assert.NoError(ts.SaveEvent(ctx, kept))
+	assert.NoError(ts.SaveEvent(ctx, added))
+	fake.aliases["amb"] = "amb_v2"
+	assert.NoError(ts.SaveEvent(ctx, kept))
+	assert.NoError(ts.SaveEvent(ctx, deleted))
+	copied := map[string]string{documentID(kept): kept.ID, documentID(deleted): deleted.ID}
+
+	changed, removed, err := ts.changedEvents(ctx, "amb_v1", copied)
+	assert.NoError(err)
+	if assert.Len(changed, 1) {
+		assert.Equal(added.ID, changed[0].EventID)
+	}
+	assert.Equal(map[string]string{documentID(deleted): deleted.ID}, removed)
+
+	assert.NoError(ts.applyChanges(ctx, changed, removed))
+
+	documents := fake.collection("amb")
+	assert.Len(documents, 2)
+	assert.Contains(documents, documentID(kept))
+	assert.Contains(documents, documentID(added))
+}
+
+func TestInit_AdoptsCollectionWithoutAlias(t *testing.T) {
+	assert := assert.New(t)
+
+	// A Reindex dropped the legacy collection but failed to create the alias
+	fake := newFakeTypesense(t)
+	fake.collection("amb_v1")["doc"] = json.RawMessage(`{"id": "doc"}`)
+	ts := fake.backend()
+
+	assert.NoError(ts.Init())
+
+	assert.Equal("amb_v1", fake.aliases["amb"])
+	assert.NotContains(fake.collections, "amb_v2")
+	assert.Len(fake.collection("amb"), 1)
+}
+
+func TestReindex_StreamsLongExports(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	ctx := context.Background()
+
+	// Exports are read line by line, documents larger than the default buffer
+	// of bufio.Scanner are still copied
+	event := createTestEvent(nostr.Tags{{"d", "resource-1"}, {"description", strings.Repeat("Bruchrechnung ", 10000)}})
+	assert.NoError(ts.SaveEvent(ctx, event))
+
+	assert.NoError(ts.Reindex(ctx))
+
+	assert.Equal(event.ID, fake.document(documentID(event)).EventID)
+}
+
+func TestApplyChanges_KeepsRepublishedDocument(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	fake.aliases["amb"] = "amb_v2"
+	ts := fake.backend()
+	ctx := context.Background()
+
+	// Deleted from the old collection during the copy and republished after
+	// the alias was swapped
+	fake.collection("amb_v2")["doc"] = json.RawMessage(`{"id": "doc", "eventID": "republished"}`)
+
+	assert.NoError(ts.applyChanges(ctx, nil, map[string]string{"doc": "copied"}))
+	assert.Contains(fake.collection("amb"), "doc")
+
+	assert.NoError(ts.applyChanges(ctx, nil, map[string]string{"doc": "republished"}))
+	assert.NotContains(fake.collection("amb"), "doc")
+}
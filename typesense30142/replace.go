@@ -2,70 +2,204 @@ package typesense30142
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"net/http"
+	"net/url"
 
 	"github.com/nbd-wtf/go-nostr"
 )
 
-// IndexNostrEvent converts a Nostr event to AMB metadata and indexes it in Typesense
-func (ts *TSBackend) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+// ReplaceEvent converts a Nostr event to AMB metadata and indexes it in Typesense.
+// Replaceable and addressable events are stored under a document id derived from
+// their address, so the new version is upserted over the old one in a single
+// request. Versions older than the indexed one are rejected with ErrOlderEvent,
+// deleted events with ErrTombstoned.
+//
+// The check for older versions and the upsert are only serialized within this
+// backend. Typesense can't make the upsert conditional, so a single relay
+// process must write to a collection, otherwise an older version can overwrite
+// a newer one written concurrently by another process.
+func (ts *TSBackend) ReplaceEvent(ctx context.Context, event *nostr.Event) (err error) {
+	ctx, span := ts.startSpan(ctx, "typesense.ReplaceEvent", eventSpanAttrs(event)...)
+	defer func() { endSpan(span, err) }()
+
+	return ts.replaceEvent(ctx, event, nil)
+}
+
+// replaceEvent implements ReplaceEvent and returns dup if the event is already
+// indexed, under its document id or under its event id like releases before
+// address-derived document ids stored it
+func (ts *TSBackend) replaceEvent(ctx context.Context, event *nostr.Event, dup error) error {
+	ambData, err := eventToDocument(event)
+	if err != nil {
+		return err
+	}
+
+	if err := ts.checkTombstones(ctx, event); err != nil {
+		return err
+	}
+
+	// Typesense has no compare-and-swap, so replacements of the same document
+	// are serialized within this process, see the single writer assumption above
+	unlock := ts.lockDocument(ambData.ID)
+	defer unlock()
+
+	stored, err := ts.getDocument(ctx, ambData.ID)
+	if err != nil {
+		return err
+	}
+
+	if stored == nil && dup != nil && ambData.ID != event.ID {
+		if stored, err = ts.getDocument(ctx, event.ID); err != nil {
+			return err
+		}
+		if stored != nil {
+			ts.metrics().CountEvents(EventRejected, 1)
+			return dup
+		}
+	}
+
+	if stored != nil {
+		if stored.EventID == event.ID {
+			if dup != nil {
+				ts.metrics().CountEvents(EventRejected, 1)
+			}
+			return dup
+		}
+		if !supersedes(event, stored) {
+			ts.metrics().CountEvents(EventRejected, 1)
+			ts.logger().DebugContext(ctx, "rejected older version", append(eventAttrs(event), "indexed_event_id", stored.EventID)...)
+			return ErrOlderEvent
+		}
+	}
+
+	if err := ts.upsertDocument(ctx, ambData); err != nil {
+		return err
+	}
+	ts.logger().DebugContext(ctx, "replaced event", append(eventAttrs(event), "document_id", ambData.ID)...)
+
+	if stored != nil {
+		ts.metrics().CountEvents(EventReplaced, 1)
+	} else {
+		ts.metrics().CountEvents(EventIndexed, 1)
+	}
+
+	// Remove versions of the same address that were indexed under another document id
+	return ts.deleteStaleVersions(ctx, ambData)
+}
+
+// eventToDocument converts a Nostr event to the AMB document stored in Typesense
+func eventToDocument(event *nostr.Event) (*AMBMetadata, error) {
 	ambData, err := NostrToAMB(event)
 	if err != nil {
-		return fmt.Errorf("error converting Nostr event to AMB metadata: %v", err)
+		return nil, fmt.Errorf("error converting Nostr event to AMB metadata: %v", err)
 	}
 
-	// check if event is already there, if so replace it, else index it
-	alreadyIndexed, err := ts.eventAlreadyIndexed(ambData)
-	return ts.indexDocument(ctx, ambData, alreadyIndexed)
+	ambData.ID = documentID(event)
+	return ambData, nil
 }
 
-func (ts *TSBackend) eventAlreadyIndexed(doc *AMBMetadata) (*nostr.Event, error) {
-	url := fmt.Sprintf(
-		"%s/collections/%s/documents/search?filter_by=d:=%s&&eventPubKey:=%s&q=&query_by=d,eventPubKey",
-		ts.Host, ts.CollectionName, doc.D, doc.EventPubKey)
+// documentID derives the Typesense document id of an event. Replaceable and
+// addressable events share one document per address (kind:pubkey:d), all other
+// events are stored under their event id.
+func documentID(event *nostr.Event) string {
+	if !nostr.IsReplaceableKind(event.Kind) && !nostr.IsAddressableKind(event.Kind) {
+		return event.ID
+	}
+
+	return addressID(event.Kind, event.PubKey, event.Tags.GetD())
+}
 
-	resp, body, err := ts.makehttpRequest(url, http.MethodGet, nil)
+// addressID hashes an event address (kind:pubkey:d) into a Typesense document id
+func addressID(kind int, pubkey string, d string) string {
+	address := fmt.Sprintf("%d:%s:%s", kind, pubkey, d)
+	hash := sha256.Sum256([]byte(address))
+	return hex.EncodeToString(hash[:])
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Search for event failed, status: %d, body: %s", resp.StatusCode, string(body))
+// supersedes reports whether the event replaces the stored version as specified
+// by NIP-01: the newer event wins and on equal timestamps the lowest id is kept
+func supersedes(event *nostr.Event, stored *NostrMetadata) bool {
+	if event.CreatedAt != stored.EventCreatedAt {
+		return event.CreatedAt > stored.EventCreatedAt
 	}
+	return event.ID < stored.EventID
+}
+
+// lockDocument locks the document id against concurrent replacements and returns the unlock func
+func (ts *TSBackend) lockDocument(id string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+
+	mu := &ts.documentLocks[hash.Sum32()%uint32(len(ts.documentLocks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// getDocument fetches the nostr metadata of an indexed document, nil if there is none
+func (ts *TSBackend) getDocument(ctx context.Context, id string) (*NostrMetadata, error) {
+	path := ts.documentsPath("/"+url.PathEscape(id), nil)
 
-	events, err := parseSearchResponse(body)
+	resp, body, err := ts.makehttpRequest(ctx, opGet, path, http.MethodGet, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Error while parsing search response: %v", err)
+		return nil, fmt.Errorf("request failed: %w", err)
 	}
 
-	// Check if we found any events
-	if len(events) == 0 {
+	if resp.StatusCode == http.StatusNotFound {
 		return nil, nil
 	}
-	return &events[0], nil
-}
 
-// Index a document in Typesense
-func (ts *TSBackend) indexDocument(ctx context.Context, doc *AMBMetadata, alreadyIndexedEvent *nostr.Event) error {
-	if alreadyIndexedEvent != nil {
-		fmt.Println("deleting old event for new one")
-		ts.DeleteEvent(ctx, alreadyIndexedEvent)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch document: %w", newTypesenseError(resp, body))
+	}
+
+	var stored NostrMetadata
+	if err := json.Unmarshal(body, &stored); err != nil {
+		return nil, fmt.Errorf("error parsing document: %v", err)
 	}
 
-	url := fmt.Sprintf("%s/collections/%s/documents", ts.Host, ts.CollectionName)
+	return &stored, nil
+}
+
+// upsertDocument creates the document or overwrites the one with the same id
+func (ts *TSBackend) upsertDocument(ctx context.Context, doc *AMBMetadata) error {
+	path := ts.documentsPath("", url.Values{"action": {"upsert"}})
 	jsonData, err := json.Marshal(doc)
 	if err != nil {
 		return err
 	}
-	resp, body, err := ts.makehttpRequest(url, http.MethodPost, jsonData)
+
+	resp, body, err := ts.makehttpRequest(ctx, opUpsert, path, http.MethodPost, jsonData)
 	if err != nil {
-		return fmt.Errorf("request failed: %v", err)
+		return fmt.Errorf("request failed: %w", err)
 	}
 
 	// Check status code and handle errors
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to index document, status: %d, body: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("failed to index document: %w", newTypesenseError(resp, body))
 	}
 
 	return nil
 }
 
+// deleteStaleVersions removes all documents with the same address as doc but a different document id
+func (ts *TSBackend) deleteStaleVersions(ctx context.Context, doc *AMBMetadata) error {
+	if !nostr.IsReplaceableKind(doc.EventKind) && !nostr.IsAddressableKind(doc.EventKind) {
+		return nil
+	}
+
+	filterBy := (&FilterBuilder{}).
+		Equals("d", doc.D).
+		Equals("eventPubKey", doc.EventPubKey).
+		EqualsInt("eventKind", doc.EventKind).
+		NotEquals("id", doc.ID)
+	if _, err := ts.deleteByFilter(ctx, filterBy); err != nil {
+		return fmt.Errorf("failed to delete stale versions: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package typesense30142
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDocumentID(t *testing.T) {
+	assert := assert.New(t)
+
+	sk := nostr.GeneratePrivateKey()
+	first := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	first.Sign(sk)
+	second := &nostr.Event{Kind: 30142, CreatedAt: 2000, Tags: nostr.Tags{{"d", "resource"}}}
+	second.Sign(sk)
+	other := &nostr.Event{Kind: 30142, CreatedAt: 2000, Tags: nostr.Tags{{"d", "other"}}}
+	other.Sign(sk)
+	regular := &nostr.Event{Kind: 1, CreatedAt: 2000}
+	regular.Sign(sk)
+
+	assert.Equal(documentID(first), documentID(second))
+	assert.NotEqual(documentID(first), documentID(other))
+	assert.Equal(regular.ID, documentID(regular))
+}
+
+func TestReplaceEvent_Ordering(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	sk := nostr.GeneratePrivateKey()
+	ctx := context.Background()
+
+	newer := &nostr.Event{Kind: 30142, CreatedAt: 2000, Tags: nostr.Tags{{"d", "resource"}}}
+	newer.Sign(sk)
+	older := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	older.Sign(sk)
+
+	assert.NoError(ts.ReplaceEvent(ctx, newer))
+	assert.ErrorIs(ts.ReplaceEvent(ctx, older), ErrOlderEvent)
+	assert.NoError(ts.ReplaceEvent(ctx, newer))
+
+	assert.Len(fake.collection("amb"), 1)
+	assert.Equal(newer.ID, fake.document(documentID(newer)).EventID)
+}
+
+func TestReplaceEvent_TieBreak(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	sk := nostr.GeneratePrivateKey()
+	ctx := context.Background()
+
+	a := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}, Content: "a"}
+	a.Sign(sk)
+	b := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}, Content: "b"}
+	b.Sign(sk)
+	lowest, highest := a, b
+	if b.ID < a.ID {
+		lowest, highest = b, a
+	}
+
+	assert.NoError(ts.ReplaceEvent(ctx, highest))
+	assert.NoError(ts.ReplaceEvent(ctx, lowest))
+	assert.ErrorIs(ts.ReplaceEvent(ctx, highest), ErrOlderEvent)
+	assert.Equal(lowest.ID, fake.document(documentID(lowest)).EventID)
+}
+
+func TestReplaceEvent_Concurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	sk := nostr.GeneratePrivateKey()
+
+	events := make([]*nostr.Event, 20)
+	for i := range events {
+		events[i] = &nostr.Event{Kind: 30142, CreatedAt: nostr.Timestamp(1000 + i), Tags: nostr.Tags{{"d", "resource"}}}
+		events[i].Sign(sk)
+	}
+
+	var wg sync.WaitGroup
+	for _, event := range events {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ts.ReplaceEvent(context.Background(), event)
+		}()
+	}
+	wg.Wait()
+
+	newest := events[len(events)-1]
+	assert.Len(fake.collection("amb"), 1)
+	assert.Equal(newest.ID, fake.document(documentID(newest)).EventID)
+}
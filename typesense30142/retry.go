@@ -0,0 +1,214 @@
+package typesense30142
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxAttempts      = 3
+	defaultBaseDelay        = 100 * time.Millisecond
+	defaultMaxDelay         = 5 * time.Second
+	defaultFailureThreshold = 5
+	defaultCooldown         = 10 * time.Second
+)
+
+// RetryPolicy configures how failed requests to Typesense are retried. Only
+// requests that are safe to repeat are retried, on network errors, timeouts
+// and 408, 429, 502, 503 and 504 responses.
+type RetryPolicy struct {
+	// MaxAttempts including the first one, 1 disables retries. Defaults to 3.
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, doubled for every
+	// further retry. Defaults to 100ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff as well as delays asked for with Retry-After.
+	// Defaults to 5s.
+	MaxDelay time.Duration
+}
+
+// CircuitBreakerConfig configures when requests to Typesense fail fast with ErrCircuitOpen
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failed requests that open
+	// the circuit. Defaults to 5, a negative value disables the breaker.
+	FailureThreshold int
+	// Cooldown is how long the circuit stays open before a single trial
+	// request is let through. Defaults to 10s.
+	Cooldown time.Duration
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaultMaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultBaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultMaxDelay
+	}
+	return p
+}
+
+// backoff returns the delay before the given retry, preferring the Retry-After of the response
+func (p RetryPolicy) backoff(retry int, resp *http.Response) time.Duration {
+	if delay, ok := retryAfter(resp); ok {
+		return min(delay, p.MaxDelay)
+	}
+
+	delay := p.BaseDelay << (retry - 1)
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	// Jitter spreads retries of concurrent requests
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryAfter parses the Retry-After header given in seconds or as HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return max(time.Until(date), 0), true
+	}
+
+	return 0, false
+}
+
+// retryable reports whether a request may be sent again without changing its outcome
+func retryable(op operation, method string) bool {
+	switch op {
+	case opCreate:
+		// Repeating a create that went through would report a conflict
+		return false
+	case opCollection:
+		return method == http.MethodGet
+	}
+	return true
+}
+
+// temporaryFailure reports whether the outcome of a request is worth a retry
+// and counts as failure for the circuit breaker
+func temporaryFailure(resp *http.Response, err error) bool {
+	return err != nil || temporaryStatus(resp.StatusCode)
+}
+
+// temporaryStatus reports whether Typesense answered with a status that says
+// it is overloaded or unavailable for now. Other errors like 500 are returned
+// right away, repeating the request wouldn't change them.
+func temporaryStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// sleep waits for the delay or until the context is done
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// circuitBreaker tracks consecutive failures of requests to Typesense
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	// trial is set while the single request after the cooldown is in flight
+	trial bool
+}
+
+// allow reports whether a request may be sent and whether it is the trial
+// request after the cooldown, which has to be settled with record or release
+func (cb *circuitBreaker) allow(config CircuitBreakerConfig) (allowed bool, trial bool) {
+	if config.FailureThreshold < 0 {
+		return true, false
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.openUntil.IsZero() {
+		return true, false
+	}
+
+	if cb.trial || time.Now().Before(cb.openUntil) {
+		return false, false
+	}
+
+	cb.trial = true
+	return true, true
+}
+
+// record updates the breaker with the outcome of a request
+func (cb *circuitBreaker) record(config CircuitBreakerConfig, failed bool) {
+	if config.FailureThreshold < 0 {
+		return
+	}
+
+	threshold := config.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultFailureThreshold
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.trial = false
+	if !failed {
+		cb.failures = 0
+		cb.openUntil = time.Time{}
+		return
+	}
+
+	cb.failures++
+	if cb.failures >= threshold {
+		cb.openUntil = time.Now().Add(config.cooldown())
+	}
+}
+
+// release ends a trial request without an outcome, e.g. because the caller
+// cancelled it. The circuit stays open for another cooldown without counting
+// a failure.
+func (cb *circuitBreaker) release(config CircuitBreakerConfig) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if !cb.trial {
+		return
+	}
+	cb.trial = false
+	cb.openUntil = time.Now().Add(config.cooldown())
+}
+
+func (c CircuitBreakerConfig) cooldown() time.Duration {
+	if c.Cooldown <= 0 {
+		return defaultCooldown
+	}
+	return c.Cooldown
+}
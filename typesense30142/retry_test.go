@@ -0,0 +1,238 @@
+package typesense30142
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyServer answers the first failures requests with the status, all further ones with 200
+func flakyServer(t *testing.T, failures int32, status int, header http.Header) (*httptest.Server, *atomic.Int32) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(`{"found": 0, "hits": [], "num_deleted": 0}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestRetry_Unavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requests := flakyServer(t, 2, http.StatusServiceUnavailable, nil)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Retry: RetryPolicy{BaseDelay: time.Millisecond}}
+
+	_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+
+	assert.NoError(err)
+	assert.Equal(int32(3), requests.Load())
+}
+
+func TestRetry_GivesUp(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requests := flakyServer(t, 10, http.StatusServiceUnavailable, nil)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Retry: RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond}}
+
+	_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+
+	assert.Error(err)
+	assert.Equal(int32(4), requests.Load())
+}
+
+func TestRetry_NotForCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requests := flakyServer(t, 1, http.StatusServiceUnavailable, nil)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Retry: RetryPolicy{BaseDelay: time.Millisecond}}
+
+	resp, _, err := ts.makehttpRequest(context.Background(), opCreate, ts.documentsPath("", nil), http.MethodPost, []byte(`{}`))
+
+	assert.NoError(err)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(int32(1), requests.Load())
+}
+
+func TestRetry_NotForClientErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requests := flakyServer(t, 1, http.StatusBadRequest, nil)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Retry: RetryPolicy{BaseDelay: time.Millisecond}}
+
+	_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+
+	assert.Error(err)
+	assert.Equal(int32(1), requests.Load())
+}
+
+func TestRetry_NotForServerErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requests := flakyServer(t, 1, http.StatusInternalServerError, nil)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Retry: RetryPolicy{BaseDelay: time.Millisecond}}
+
+	_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+
+	assert.Error(err)
+	assert.NotErrorIs(err, ErrUnavailable)
+	assert.Equal(int32(1), requests.Load())
+}
+
+func TestRetry_RetryAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requests := flakyServer(t, 1, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}})
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Retry: RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: 50 * time.Millisecond}}
+
+	start := time.Now()
+	_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+
+	assert.NoError(err)
+	assert.Equal(int32(2), requests.Load())
+	// Retry-After is honored but capped by MaxDelay
+	assert.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+	assert.Less(time.Since(start), time.Second)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert := assert.New(t)
+
+	delay, ok := retryAfter(&http.Response{Header: http.Header{"Retry-After": {"3"}}})
+	assert.True(ok)
+	assert.Equal(3*time.Second, delay)
+
+	delay, ok = retryAfter(&http.Response{Header: http.Header{"Retry-After": {time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}}})
+	assert.True(ok)
+	assert.Equal(time.Duration(0), delay)
+
+	_, ok = retryAfter(&http.Response{Header: http.Header{}})
+	assert.False(ok)
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	policy := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}.withDefaults()
+
+	for retry := 1; retry <= 10; retry++ {
+		delay := policy.backoff(retry, nil)
+		assert.LessOrEqual(delay, time.Second)
+		assert.GreaterOrEqual(delay, min(100*time.Millisecond<<(retry-1), time.Second)/2)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requests := flakyServer(t, 4, http.StatusServiceUnavailable, nil)
+	ts := &TSBackend{
+		Host:           server.URL,
+		CollectionName: "amb",
+		Retry:          RetryPolicy{MaxAttempts: 1},
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, Cooldown: 50 * time.Millisecond},
+	}
+	ctx := context.Background()
+
+	// two failures open the circuit
+	_, err := ts.SearchResources(ctx, nostr.Filter{})
+	assert.Error(err)
+	_, err = ts.SearchResources(ctx, nostr.Filter{})
+	assert.Error(err)
+
+	// while open, requests fail fast without reaching Typesense
+	_, err = ts.SearchResources(ctx, nostr.Filter{})
+	assert.ErrorIs(err, ErrCircuitOpen)
+	assert.Equal(int32(2), requests.Load())
+
+	// after the cooldown a failing trial request opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	_, err = ts.SearchResources(ctx, nostr.Filter{})
+	assert.Error(err)
+	assert.NotErrorIs(err, ErrCircuitOpen)
+	_, err = ts.SearchResources(ctx, nostr.Filter{})
+	assert.ErrorIs(err, ErrCircuitOpen)
+
+	// a successful trial request closes it
+	time.Sleep(60 * time.Millisecond)
+	requests.Store(10)
+	_, err = ts.SearchResources(ctx, nostr.Filter{})
+	assert.NoError(err)
+	_, err = ts.SearchResources(ctx, nostr.Filter{})
+	assert.NoError(err)
+}
+
+func TestCircuitBreaker_CancelledTrial(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1, 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			// The trial request hangs until the caller gives up
+			<-r.Context().Done()
+		default:
+			w.Write([]byte(`{"found": 0, "hits": []}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	ts := &TSBackend{
+		Host:           server.URL,
+		CollectionName: "amb",
+		Retry:          RetryPolicy{MaxAttempts: 1},
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, Cooldown: 50 * time.Millisecond},
+	}
+
+	for range 2 {
+		_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+		assert.Error(err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := ts.SearchResources(ctx, nostr.Filter{})
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	// The cancelled trial restarts the cooldown instead of blocking the circuit
+	_, err = ts.SearchResources(context.Background(), nostr.Filter{})
+	assert.ErrorIs(err, ErrCircuitOpen)
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = ts.SearchResources(context.Background(), nostr.Filter{})
+	assert.NoError(err)
+	assert.Equal(int32(4), requests.Load())
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	assert := assert.New(t)
+
+	server, requests := flakyServer(t, 10, http.StatusServiceUnavailable, nil)
+	ts := &TSBackend{
+		Host:           server.URL,
+		CollectionName: "amb",
+		Retry:          RetryPolicy{MaxAttempts: 1},
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: -1},
+	}
+
+	for range 8 {
+		_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+		assert.NotErrorIs(err, ErrCircuitOpen)
+	}
+	assert.Equal(int32(8), requests.Load())
+}
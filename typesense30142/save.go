@@ -0,0 +1,56 @@
+package typesense30142
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// SaveEvent converts a Nostr event to AMB metadata and indexes it in Typesense.
+// It returns eventstore.ErrDupEvent if the event is already indexed and
+// ErrTombstoned if it was deleted before. Replaceable and addressable events
+// share one document per address, they are saved like with ReplaceEvent.
+func (ts *TSBackend) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	if nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind) {
+		return ts.replaceEvent(ctx, event, eventstore.ErrDupEvent)
+	}
+
+	ambData, err := eventToDocument(event)
+	if err != nil {
+		return err
+	}
+
+	if err := ts.checkTombstones(ctx, event); err != nil {
+		return err
+	}
+
+	path := ts.documentsPath("", nil)
+	jsonData, err := json.Marshal(ambData)
+	if err != nil {
+		return err
+	}
+
+	// Typesense creates documents by default and refuses to overwrite an existing id
+	resp, body, err := ts.makehttpRequest(ctx, opCreate, path, http.MethodPost, jsonData)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+
+	// Other events are stored under their event id
+	if resp.StatusCode == http.StatusConflict {
+		ts.metrics().CountEvents(EventRejected, 1)
+		return eventstore.ErrDupEvent
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to save event: %w", newTypesenseError(resp, body))
+	}
+
+	ts.metrics().CountEvents(EventIndexed, 1)
+	ts.logger().DebugContext(ctx, "indexed event", eventAttrs(event)...)
+	return nil
+}
@@ -0,0 +1,63 @@
+package typesense30142
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	event := createTestEvent(nostr.Tags{{"d", "test-resource-id"}, {"name", "Test Resource"}})
+
+	assert.NoError(ts.SaveEvent(context.Background(), event))
+	assert.Equal(event.ID, fake.document(documentID(event)).EventID)
+	assert.ErrorIs(ts.SaveEvent(context.Background(), event), eventstore.ErrDupEvent)
+}
+
+func TestSaveEvent_NewerVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	sk := nostr.GeneratePrivateKey()
+
+	older := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	older.Sign(sk)
+	newer := &nostr.Event{Kind: 30142, CreatedAt: 2000, Tags: nostr.Tags{{"d", "resource"}}}
+	newer.Sign(sk)
+
+	assert.NoError(ts.SaveEvent(context.Background(), older))
+	assert.NoError(ts.SaveEvent(context.Background(), newer))
+	assert.Len(fake.collection("amb"), 1)
+	assert.Equal(newer.ID, fake.document(documentID(newer)).EventID)
+}
+
+func TestSaveEvent_LegacyDocument(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	sk := nostr.GeneratePrivateKey()
+
+	// Indexed under its event id before documents ids were derived from the address
+	older := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	older.Sign(sk)
+	fake.collection("amb")[older.ID] = legacyDocument(older)
+
+	assert.ErrorIs(ts.SaveEvent(context.Background(), older), eventstore.ErrDupEvent)
+	assert.Len(fake.collection("amb"), 1)
+
+	newer := &nostr.Event{Kind: 30142, CreatedAt: 2000, Tags: nostr.Tags{{"d", "resource"}}}
+	newer.Sign(sk)
+
+	assert.NoError(ts.SaveEvent(context.Background(), newer))
+	assert.Len(fake.collection("amb"), 1)
+	assert.Equal(newer.ID, fake.document(documentID(newer)).EventID)
+}
@@ -0,0 +1,488 @@
+package typesense30142
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// schemaVersionKey is the key of the schema version in the collection metadata
+const schemaVersionKey = "schema_version"
+
+// Versions of the collection schemas. Bump them with every change of
+// ambCollectionSchema or tombstoneCollectionSchema, Init migrates collections
+// created with an older version.
+const (
+	ambSchemaVersion       = 3
+	tombstoneSchemaVersion = 1
+)
+
+// ambSchemaFields are the fields of the AMB collection, derived from the
+// typesense struct tags of AMBMetadata
+var ambSchemaFields = mustSchemaFields(reflect.TypeFor[AMBMetadata]())
+
+// mustSchemaFields is schemaFields for struct types known at compile time, it
+// panics if their tags are malformed
+func mustSchemaFields(t reflect.Type) []Field {
+	fields, err := schemaFields(t)
+	if err != nil {
+		panic(err)
+	}
+	return fields
+}
+
+// schemaFields derives the collection fields from the json and typesense tags
+// of a struct, including the fields of embedded structs. The typesense tag is a
+// comma separated list of options:
+//
+//	type=string[]  Typesense type, inferred from the Go type if not given
+//	facet          the field can be faceted
+//	optional       documents may leave the field out
+//	index=false    the field is stored but not indexed
+//	sort, sort=false
+//	               whether the field can be sorted by
+//	locale=de      the locale used to tokenize the field
+//	infix          the field can be searched for infixes
+//	stem           words of the field are stemmed
+//
+// Fields tagged with typesense:"-" are not part of the schema.
+func schemaFields(t reflect.Type) ([]Field, error) {
+	var fields []Field
+
+	for _, structField := range reflect.VisibleFields(t) {
+		if !structField.IsExported() || len(structField.Index) > 1 {
+			continue
+		}
+
+		name, _, _ := strings.Cut(structField.Tag.Get("json"), ",")
+		if name == "-" || structField.Tag.Get("typesense") == "-" {
+			continue
+		}
+
+		if structField.Anonymous && name == "" {
+			embedded, err := schemaFields(structField.Type)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, embedded...)
+			continue
+		}
+
+		if name == "" {
+			name = structField.Name
+		}
+
+		field, err := schemaField(name, structField.Type, structField.Tag.Get("typesense"))
+		if err != nil {
+			return nil, fmt.Errorf("field %s of %s: %w", structField.Name, t.Name(), err)
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// schemaField builds the collection field from the options of a typesense tag
+func schemaField(name string, goType reflect.Type, tag string) (Field, error) {
+	field := Field{Name: name}
+
+	for _, option := range strings.Split(tag, ",") {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(option), "=")
+		switch key {
+		case "":
+		case "type":
+			field.Type = value
+		case "facet":
+			field.Facet = true
+		case "optional":
+			field.Optional = true
+		case "index", "sort":
+			enabled := true
+			if hasValue {
+				var err error
+				if enabled, err = strconv.ParseBool(value); err != nil {
+					return field, fmt.Errorf("invalid %s option %q", key, value)
+				}
+			}
+			if key == "index" {
+				field.Index = &enabled
+			} else {
+				field.Sort = &enabled
+			}
+		case "locale":
+			field.Locale = value
+		case "infix":
+			field.Infix = true
+		case "stem":
+			field.Stem = true
+		default:
+			return field, fmt.Errorf("unknown typesense option %q", key)
+		}
+	}
+
+	if field.Type == "" {
+		inferred, ok := typesenseType(goType)
+		if !ok {
+			return field, fmt.Errorf("no Typesense type for %s, set one with type=", goType)
+		}
+		field.Type = inferred
+	}
+
+	return field, nil
+}
+
+// typesenseType maps a Go type to the Typesense type of its JSON encoding
+func typesenseType(goType reflect.Type) (string, bool) {
+	if goType.Kind() == reflect.Pointer {
+		goType = goType.Elem()
+	}
+
+	if goType.Kind() == reflect.Slice {
+		elem, ok := typesenseType(goType.Elem())
+		if !ok || strings.HasSuffix(elem, "[]") {
+			return "", false
+		}
+		return elem + "[]", true
+	}
+
+	switch goType.Kind() {
+	case reflect.String:
+		return "string", true
+	case reflect.Bool:
+		return "bool", true
+	case reflect.Int32:
+		return "int32", true
+	case reflect.Int, reflect.Int64:
+		return "int64", true
+	case reflect.Float32, reflect.Float64:
+		return "float", true
+	case reflect.Struct:
+		return "object", true
+	}
+
+	return "", false
+}
+
+// SchemaOptions customize the AMB collection of a deployment. They are merged
+// with the built-in schema at Init. Fields are named like in the documents,
+// fields of nested objects with a dot, e.g. "educationalLevel.prefLabel".
+// Changing the options of existing fields requires a Reindex.
+type SchemaOptions struct {
+	// FacetFields can be faceted
+	FacetFields []string
+	// SortFields can be sorted by
+	SortFields []string
+	// Locales sets the locale used to tokenize a field, e.g. {"name": "de"}
+	Locales map[string]string
+	// InfixFields can be searched for infixes
+	InfixFields []string
+	// StemFields are stemmed, so that searches match inflected words
+	StemFields []string
+	// ExtraFields are added to the schema, replacing built-in fields of the same name
+	ExtraFields []Field
+}
+
+// apply merges the options into the schema
+func (options SchemaOptions) apply(schema *CollectionSchema) error {
+	for _, extra := range options.ExtraFields {
+		if i := slices.IndexFunc(schema.Fields, func(field Field) bool { return field.Name == extra.Name }); i >= 0 {
+			schema.Fields[i] = extra
+		} else {
+			schema.Fields = append(schema.Fields, extra)
+		}
+	}
+
+	customize := func(names []string, set func(*Field)) error {
+		var errs []error
+		for _, name := range names {
+			field, err := schemaFieldByName(schema, name)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			set(field)
+		}
+		return errors.Join(errs...)
+	}
+
+	enabled := true
+	locales := slices.Sorted(maps.Keys(options.Locales))
+
+	return errors.Join(
+		customize(options.FacetFields, func(field *Field) { field.Facet = true }),
+		customize(options.SortFields, func(field *Field) { field.Sort = &enabled }),
+		customize(options.InfixFields, func(field *Field) { field.Infix = true }),
+		customize(options.StemFields, func(field *Field) { field.Stem = true }),
+		customize(locales, func(field *Field) { field.Locale = options.Locales[field.Name] }),
+	)
+}
+
+// schemaFieldByName returns the field of the schema with the name. Fields of
+// nested AMB objects are added to the schema as optional fields on first use.
+func schemaFieldByName(schema *CollectionSchema, name string) (*Field, error) {
+	if i := slices.IndexFunc(schema.Fields, func(field Field) bool { return field.Name == name }); i >= 0 {
+		return &schema.Fields[i], nil
+	}
+
+	fieldType, ok := nestedFieldType(reflect.TypeFor[AMBMetadata](), strings.Split(name, "."), false)
+	if !ok || !strings.Contains(name, ".") {
+		return nil, fmt.Errorf("unknown field %s", name)
+	}
+
+	schema.Fields = append(schema.Fields, Field{Name: name, Type: fieldType, Optional: true})
+	return &schema.Fields[len(schema.Fields)-1], nil
+}
+
+// nestedFieldType returns the Typesense type of a path of json field names
+// below a struct. Values nested in arrays become arrays themselves.
+func nestedFieldType(t reflect.Type, path []string, inArray bool) (string, bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice {
+		return nestedFieldType(t.Elem(), path, true)
+	}
+
+	if len(path) == 0 {
+		fieldType, ok := typesenseType(t)
+		if !ok || strings.HasSuffix(fieldType, "[]") {
+			return "", false
+		}
+		if inArray {
+			fieldType += "[]"
+		}
+		return fieldType, true
+	}
+
+	if t.Kind() != reflect.Struct {
+		return "", false
+	}
+
+	for _, structField := range reflect.VisibleFields(t) {
+		name, _, _ := strings.Cut(structField.Tag.Get("json"), ",")
+		if name == path[0] && structField.IsExported() {
+			return nestedFieldType(structField.Type, path[1:], inArray)
+		}
+	}
+
+	return "", false
+}
+
+// schemaVersionMetadata returns the collection metadata recording the schema version
+func schemaVersionMetadata(version int) map[string]any {
+	return map[string]any{schemaVersionKey: version}
+}
+
+// Version returns the schema version recorded in the collection metadata, 0 if there is none
+func (schema CollectionSchema) Version() int {
+	switch version := schema.Metadata[schemaVersionKey].(type) {
+	case int:
+		return version
+	case float64:
+		return int(version)
+	}
+	return 0
+}
+
+// schemaDiff lists the differences between the live and the expected schema of a collection
+type schemaDiff struct {
+	// added are the optional fields missing from the live schema
+	added []Field
+	// changed are the fields whose facet or sort option differs, Typesense applies
+	// them in place by dropping and adding the field again
+	changed []Field
+	// outdated describes differences that only a Reindex applies, such as
+	// another locale. The collection can be searched meanwhile.
+	outdated []string
+	// conflicts describes differences that keep the collection from being used
+	conflicts []string
+}
+
+// diffSchema compares the live schema of a collection with the expected one.
+// Fields that only exist in the live schema are ignored, Typesense adds the
+// fields of nested objects by itself.
+func diffSchema(live CollectionSchema, expected CollectionSchema) schemaDiff {
+	var diff schemaDiff
+
+	liveFields := make(map[string]Field, len(live.Fields))
+	for _, field := range live.Fields {
+		liveFields[field.Name] = field
+	}
+
+	for _, field := range expected.Fields {
+		// The document id is implicit and not listed in the live schema
+		if field.Name == "id" {
+			continue
+		}
+
+		liveField, ok := liveFields[field.Name]
+		switch {
+		case !ok && field.Optional:
+			diff.added = append(diff.added, field)
+		case !ok:
+			diff.conflicts = append(diff.conflicts, fmt.Sprintf("required field %s is missing", field.Name))
+		case liveField.Type != field.Type:
+			diff.conflicts = append(diff.conflicts, fmt.Sprintf("field %s has type %s instead of %s", field.Name, liveField.Type, field.Type))
+		case liveField.Optional != field.Optional:
+			diff.conflicts = append(diff.conflicts, fmt.Sprintf("field %s has optional %t instead of %t", field.Name, liveField.Optional, field.Optional))
+		case field.Index != nil && liveField.Index != nil && *liveField.Index != *field.Index:
+			diff.conflicts = append(diff.conflicts, fmt.Sprintf("field %s has index %t instead of %t", field.Name, *liveField.Index, *field.Index))
+		case liveField.Facet != field.Facet, field.Sort != nil && sortable(liveField) != *field.Sort:
+			// Adding the field again applies its locale, infix and stem options as well
+			diff.changed = append(diff.changed, field)
+		case liveField.Locale != field.Locale:
+			diff.outdated = append(diff.outdated, fmt.Sprintf("field %s has locale %q instead of %q", field.Name, liveField.Locale, field.Locale))
+		case liveField.Infix != field.Infix:
+			diff.outdated = append(diff.outdated, fmt.Sprintf("field %s has infix %t instead of %t", field.Name, liveField.Infix, field.Infix))
+		case liveField.Stem != field.Stem:
+			diff.outdated = append(diff.outdated, fmt.Sprintf("field %s has stem %t instead of %t", field.Name, liveField.Stem, field.Stem))
+		}
+	}
+
+	if live.DefaultSortingField != expected.DefaultSortingField {
+		diff.conflicts = append(diff.conflicts, fmt.Sprintf("default sorting field is %q instead of %q", live.DefaultSortingField, expected.DefaultSortingField))
+	}
+	if live.EnableNestedFields != expected.EnableNestedFields {
+		diff.conflicts = append(diff.conflicts, fmt.Sprintf("nested fields are %t instead of %t", live.EnableNestedFields, expected.EnableNestedFields))
+	}
+
+	return diff
+}
+
+// sortable reports whether sorting by the field is enabled, numbers are
+// sortable by default in Typesense
+func sortable(field Field) bool {
+	if field.Sort != nil {
+		return *field.Sort
+	}
+	switch field.Type {
+	case "int32", "int64", "float":
+		return true
+	}
+	return false
+}
+
+// migrateCollection brings the live schema of a collection up to the expected
+// one. Missing optional fields are added and fields with another facet or sort
+// option are replaced through the PATCH collection API. Differences that need a
+// Reindex, like another locale, are logged and the collection is used as it
+// is, all other differences are reported as ErrSchemaConflict.
+func (ts *TSBackend) migrateCollection(ctx context.Context, live CollectionSchema, expected CollectionSchema) error {
+	if live.Version() > expected.Version() {
+		return fmt.Errorf("%w: collection %s has schema version %d, this release knows version %d",
+			ErrSchemaConflict, expected.Name, live.Version(), expected.Version())
+	}
+
+	diff := diffSchema(live, expected)
+	if len(diff.conflicts) > 0 {
+		return fmt.Errorf("%w: collection %s can't be migrated in place: %s",
+			ErrSchemaConflict, expected.Name, strings.Join(diff.conflicts, "; "))
+	}
+
+	if len(diff.outdated) > 0 {
+		ts.logger().WarnContext(ctx, "collection schema differs, run Reindex to apply the changes",
+			"collection", expected.Name,
+			"differences", diff.outdated)
+	}
+
+	if len(diff.added) == 0 && len(diff.changed) == 0 && live.Version() == expected.Version() {
+		return nil
+	}
+
+	if err := ts.patchCollection(ctx, expected.Name, diff.changed, diff.added, expected.Metadata); err != nil {
+		return err
+	}
+
+	ts.logger().InfoContext(ctx, "migrated collection",
+		"collection", expected.Name,
+		"from_version", live.Version(),
+		"to_version", expected.Version(),
+		"added_fields", fieldNames(diff.added),
+		"changed_fields", fieldNames(diff.changed))
+
+	return nil
+}
+
+func fieldNames(fields []Field) []string {
+	names := make([]string, 0, len(fields))
+	for _, field := range fields {
+		names = append(names, field.Name)
+	}
+	return names
+}
+
+// getCollection returns the live schema of a collection or nil if it doesn't exist
+func (ts *TSBackend) getCollection(ctx context.Context, name string) (*CollectionSchema, error) {
+	path := "/collections/" + url.PathEscape(name)
+
+	resp, body, err := ts.makehttpRequest(ctx, opCollection, path, http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	// 404 means collection doesn't exist
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	// Any status code other than 200 is an error
+	if resp.StatusCode != http.StatusOK {
+		return nil, newTypesenseError(resp, body)
+	}
+
+	var schema CollectionSchema
+	if err := json.Unmarshal(body, &schema); err != nil {
+		return nil, fmt.Errorf("error parsing collection %s: %v", name, err)
+	}
+
+	return &schema, nil
+}
+
+// patchCollection replaces fields of a collection, adds new ones and replaces its metadata
+func (ts *TSBackend) patchCollection(ctx context.Context, name string, replaced []Field, added []Field, metadata map[string]any) error {
+	path := "/collections/" + url.PathEscape(name)
+
+	// A field is replaced by dropping and adding it in the same request
+	type droppedField struct {
+		Name string `json:"name"`
+		Drop bool   `json:"drop"`
+	}
+	fields := make([]any, 0, 2*len(replaced)+len(added))
+	for _, field := range replaced {
+		fields = append(fields, droppedField{Name: field.Name, Drop: true}, field)
+	}
+	for _, field := range added {
+		fields = append(fields, field)
+	}
+
+	jsonData, err := json.Marshal(struct {
+		Fields   []any          `json:"fields,omitempty"`
+		Metadata map[string]any `json:"metadata,omitempty"`
+	}{fields, metadata})
+	if err != nil {
+		return err
+	}
+
+	resp, body, err := ts.makehttpRequest(ctx, opCollection, path, http.MethodPatch, jsonData)
+	if err != nil {
+		return err
+	}
+
+	// Typesense answers 400 if it refuses a field, e.g. because documents don't fit it
+	if resp.StatusCode == http.StatusBadRequest {
+		return fmt.Errorf("%w: %w", ErrSchemaConflict, newTypesenseError(resp, body))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to update collection %s: %w", name, newTypesenseError(resp, body))
+	}
+
+	return nil
+}
@@ -0,0 +1,508 @@
+package typesense30142
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// schemaServer serves the live schemas of collections and records the changes made to them
+type schemaServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	schemas map[string]CollectionSchema
+	aliases map[string]string
+	// patches records the bodies of all PATCH requests by collection
+	patches map[string][]string
+}
+
+func newSchemaServer(t *testing.T, schemas ...CollectionSchema) *schemaServer {
+	server := &schemaServer{schemas: map[string]CollectionSchema{}, aliases: map[string]string{}, patches: map[string][]string{}}
+	for _, schema := range schemas {
+		server.schemas[schema.Name] = schema
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.handle))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *schemaServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+
+	if name, ok := strings.CutPrefix(r.URL.Path, "/aliases/"); ok {
+		if r.Method == http.MethodPut {
+			var alias struct {
+				CollectionName string `json:"collection_name"`
+			}
+			json.Unmarshal(body, &alias)
+			s.aliases[name] = alias.CollectionName
+		}
+		target, ok := s.aliases[name]
+		if !ok {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"name": name, "collection_name": target})
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/collections/")
+	switch r.Method {
+	case http.MethodGet:
+		schema, ok := s.schemas[name]
+		if !ok {
+			http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(schema)
+	case http.MethodPost:
+		var schema CollectionSchema
+		json.Unmarshal(body, &schema)
+		s.schemas[schema.Name] = schema
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	case http.MethodPatch:
+		s.patches[name] = append(s.patches[name], string(body))
+		w.Write(body)
+	}
+}
+
+func TestDiffSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := CollectionSchema{
+		Fields: []Field{
+			{Name: "id", Type: "string"},
+			{Name: "name", Type: "string"},
+			{Name: "encoding", Type: "object[]", Optional: true},
+			{Name: "keywords", Type: "string[]", Optional: true},
+			{Name: "eventKind", Type: "int32"},
+		},
+		DefaultSortingField: "eventCreatedAt",
+	}
+	live := CollectionSchema{
+		Fields: []Field{
+			{Name: "name", Type: "string"},
+			{Name: "keywords", Type: "string", Optional: true},
+			{Name: "about.id", Type: "string[]", Optional: true},
+		},
+		DefaultSortingField: "eventCreatedAt",
+	}
+
+	diff := diffSchema(live, expected)
+
+	assert.Equal([]Field{{Name: "encoding", Type: "object[]", Optional: true}}, diff.added)
+	assert.Empty(diff.changed)
+	assert.Empty(diff.outdated)
+	assert.Equal([]string{
+		"field keywords has type string instead of string[]",
+		"required field eventKind is missing",
+	}, diff.conflicts)
+}
+
+func TestDiffSchema_Options(t *testing.T) {
+	assert := assert.New(t)
+
+	sortable, unsortable := true, false
+	expected := CollectionSchema{
+		Fields: []Field{
+			{Name: "name", Type: "string", Locale: "de"},
+			{Name: "keywords", Type: "string[]", Facet: true, Optional: true},
+			{Name: "description", Type: "string", Optional: true, Stem: true},
+			{Name: "nameSort", Type: "string", Optional: true, Sort: &sortable},
+		},
+	}
+	live := CollectionSchema{
+		Fields: []Field{
+			{Name: "name", Type: "string"},
+			{Name: "keywords", Type: "string[]", Optional: true},
+			{Name: "description", Type: "string", Optional: true},
+			{Name: "nameSort", Type: "string", Optional: true, Sort: &unsortable},
+		},
+	}
+
+	diff := diffSchema(live, expected)
+
+	assert.Equal([]Field{expected.Fields[1], expected.Fields[3]}, diff.changed)
+	assert.Equal([]string{
+		`field name has locale "" instead of "de"`,
+		"field description has stem false instead of true",
+	}, diff.outdated)
+	assert.Empty(diff.added)
+	assert.Empty(diff.conflicts)
+}
+
+func TestInit_CreatesVersionedCollections(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newSchemaServer(t)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	assert.NoError(ts.Init())
+
+	assert.Equal("amb_v1", server.aliases["amb"])
+	assert.Equal(ambSchemaVersion, server.schemas["amb_v1"].Version())
+	assert.Equal(tombstoneSchemaVersion, server.schemas["amb_tombstones"].Version())
+	assert.Empty(server.patches)
+}
+
+func TestInit_UpToDate(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newSchemaServer(t, ambCollectionSchema("amb"), tombstoneCollectionSchema("amb_tombstones"))
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	assert.NoError(ts.Init())
+	assert.Empty(server.patches)
+}
+
+func TestInit_AddsMissingFields(t *testing.T) {
+	assert := assert.New(t)
+
+	// A collection created before the schema was versioned and the duration was indexed
+	live := ambCollectionSchema("amb")
+	live.Metadata = nil
+	for i, field := range live.Fields {
+		if field.Name == "duration" {
+			live.Fields = append(live.Fields[:i], live.Fields[i+1:]...)
+			break
+		}
+	}
+
+	server := newSchemaServer(t, live, tombstoneCollectionSchema("amb_tombstones"))
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	assert.NoError(ts.Init())
+
+	if assert.Len(server.patches["amb"], 1) {
+		assert.JSONEq(`{
+			"fields": [{"name": "duration", "type": "string", "optional": true}],
+			"metadata": {"schema_version": 3}
+		}`, server.patches["amb"][0])
+	}
+	assert.Empty(server.patches["amb_tombstones"])
+}
+
+func TestInit_IncompatibleSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	live := ambCollectionSchema("amb")
+	live.DefaultSortingField = "eventKind"
+
+	server := newSchemaServer(t, live)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	err := ts.Init()
+
+	assert.ErrorIs(err, ErrSchemaConflict)
+	assert.ErrorContains(err, `default sorting field is "eventKind" instead of "eventCreatedAt"`)
+	assert.Empty(server.patches)
+}
+
+func TestInit_NewerSchemaVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	live := ambCollectionSchema("amb")
+	live.Metadata = schemaVersionMetadata(ambSchemaVersion + 1)
+
+	server := newSchemaServer(t, live)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	err := ts.Init()
+
+	assert.ErrorIs(err, ErrSchemaConflict)
+	assert.Empty(server.patches)
+}
+
+func TestInit_MigratesAliasedCollection(t *testing.T) {
+	assert := assert.New(t)
+
+	live := ambCollectionSchema("amb_v2")
+	live.Metadata = nil
+
+	server := newSchemaServer(t, live, tombstoneCollectionSchema("amb_tombstones"))
+	server.aliases["amb"] = "amb_v2"
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	assert.NoError(ts.Init())
+
+	assert.Len(server.patches["amb_v2"], 1)
+	assert.NotContains(server.schemas, "amb_v1")
+}
+
+// fill sets every field reachable from v to a non-zero value
+func fill(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fill(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fill(v.Index(0))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fill(v.Field(i))
+			}
+		}
+	case reflect.String:
+		v.SetString("value")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1)
+	}
+}
+
+// matchesType reports whether a decoded JSON value fits a Typesense field type
+func matchesType(value any, fieldType string) bool {
+	if elemType, ok := strings.CutSuffix(fieldType, "[]"); ok {
+		values, ok := value.([]any)
+		if !ok {
+			return false
+		}
+		for _, elem := range values {
+			if !matchesType(elem, elemType) {
+				return false
+			}
+		}
+		return true
+	}
+
+	switch fieldType {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "int32", "int64", "float":
+		_, ok := value.(float64)
+		return ok
+	case "bool":
+		_, ok := value.(bool)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	}
+	return false
+}
+
+func TestAMBSchema_MatchesStruct(t *testing.T) {
+	assert := assert.New(t)
+
+	// Every field of the document has to be declared deliberately
+	var untagged []string
+	var walk func(reflect.Type)
+	walk = func(structType reflect.Type) {
+		for i := 0; i < structType.NumField(); i++ {
+			field := structType.Field(i)
+			if field.Anonymous {
+				walk(field.Type)
+				continue
+			}
+			if _, ok := field.Tag.Lookup("typesense"); !ok {
+				untagged = append(untagged, field.Name)
+			}
+		}
+	}
+	walk(reflect.TypeFor[AMBMetadata]())
+	assert.Empty(untagged, "fields of AMBMetadata without typesense tag")
+
+	// A document with every field set has exactly the fields of the schema, with matching types
+	var doc AMBMetadata
+	fill(reflect.ValueOf(&doc).Elem())
+	jsonData, err := json.Marshal(doc)
+	assert.NoError(err)
+	var encoded map[string]any
+	assert.NoError(json.Unmarshal(jsonData, &encoded))
+
+	schema := ambCollectionSchema("amb")
+	assert.Len(schema.Fields, len(encoded))
+	for _, field := range schema.Fields {
+		value, ok := encoded[field.Name]
+		if assert.True(ok, "schema field %s is not part of the document", field.Name) {
+			assert.True(matchesType(value, field.Type), "field %s is encoded as %T, not %s", field.Name, value, field.Type)
+		}
+	}
+
+	// Required fields can't be left out by omitempty
+	var empty map[string]any
+	jsonData, _ = json.Marshal(AMBMetadata{})
+	json.Unmarshal(jsonData, &empty)
+	for _, field := range schema.Fields {
+		if !field.Optional {
+			assert.Contains(empty, field.Name, "required field %s is omitted when empty", field.Name)
+		}
+	}
+}
+
+func TestSchemaFields_Options(t *testing.T) {
+	assert := assert.New(t)
+
+	type document struct {
+		Title    string   `json:"title" typesense:"facet,sort,locale=de"`
+		Tags     []string `json:"tags,omitempty" typesense:"optional,index=false"`
+		Count    int      `json:"count" typesense:"type=int32,sort=false"`
+		Internal string   `json:"internal" typesense:"-"`
+		Skipped  string   `json:"-"`
+	}
+
+	fields, err := schemaFields(reflect.TypeFor[document]())
+	assert.NoError(err)
+
+	enabled, disabled := true, false
+	assert.Equal([]Field{
+		{Name: "title", Type: "string", Facet: true, Sort: &enabled, Locale: "de"},
+		{Name: "tags", Type: "string[]", Optional: true, Index: &disabled},
+		{Name: "count", Type: "int32", Sort: &disabled},
+	}, fields)
+}
+
+func TestSchemaFields_InvalidTags(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := schemaFields(reflect.TypeFor[struct {
+		Title string `json:"title" typesense:"facett"`
+	}]())
+	assert.ErrorContains(err, `unknown typesense option "facett"`)
+
+	_, err = schemaFields(reflect.TypeFor[struct {
+		Lookup map[string]string `json:"lookup" typesense:""`
+	}]())
+	assert.ErrorContains(err, "no Typesense type")
+}
+
+func TestSchemaOptions_Apply(t *testing.T) {
+	assert := assert.New(t)
+
+	options := SchemaOptions{
+		FacetFields: []string{"inLanguage", "keywords", "educationalLevel.prefLabel", "learningResourceType.id"},
+		SortFields:  []string{"name"},
+		Locales:     map[string]string{"name": "de", "description": "de"},
+		InfixFields: []string{"name"},
+		StemFields:  []string{"description"},
+		ExtraFields: []Field{
+			{Name: "encoding", Type: "object[]", Optional: true},
+			{Name: "image", Type: "string", Optional: true, Index: new(bool)},
+		},
+	}
+
+	schema := ambCollectionSchema("amb")
+	assert.NoError(options.apply(&schema))
+
+	fields := map[string]Field{}
+	for _, field := range schema.Fields {
+		fields[field.Name] = field
+	}
+
+	enabled := true
+	assert.Equal(Field{Name: "inLanguage", Type: "string[]", Facet: true, Optional: true}, fields["inLanguage"])
+	assert.Equal(Field{Name: "educationalLevel.prefLabel", Type: "string[]", Facet: true, Optional: true}, fields["educationalLevel.prefLabel"])
+	assert.Equal(Field{Name: "learningResourceType.id", Type: "string[]", Facet: true, Optional: true}, fields["learningResourceType.id"])
+	assert.Equal(Field{Name: "name", Type: "string", Sort: &enabled, Locale: "de", Infix: true}, fields["name"])
+	assert.Equal(Field{Name: "description", Type: "string", Optional: true, Locale: "de", Stem: true}, fields["description"])
+	assert.Equal(options.ExtraFields[0], fields["encoding"])
+	assert.Equal(options.ExtraFields[1], fields["image"])
+
+	// The built-in schema is left alone
+	assert.False(ambCollectionSchema("amb").Fields[0].Facet)
+	assert.Len(schema.Fields, len(ambSchemaFields)+3)
+}
+
+func TestSchemaOptions_UnknownField(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := ambCollectionSchema("amb")
+	err := SchemaOptions{FacetFields: []string{"educationalLevel.label", "subject"}}.apply(&schema)
+
+	assert.ErrorContains(err, "unknown field educationalLevel.label")
+	assert.ErrorContains(err, "unknown field subject")
+}
+
+func TestInit_SchemaOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newSchemaServer(t)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Schema: SchemaOptions{FacetFields: []string{"keywords"}}}
+
+	assert.NoError(ts.Init())
+
+	for _, field := range server.schemas["amb_v1"].Fields {
+		assert.Equal(field.Name == "keywords", field.Facet, field.Name)
+	}
+
+	// Faceting another existing field replaces it in place
+	ts.Schema.FacetFields = append(ts.Schema.FacetFields, "inLanguage")
+	assert.NoError(ts.Init())
+	if assert.Len(server.patches["amb_v1"], 1) {
+		assert.JSONEq(`{
+			"fields": [
+				{"name": "inLanguage", "drop": true},
+				{"name": "inLanguage", "type": "string[]", "facet": true, "optional": true}
+			],
+			"metadata": {"schema_version": 3}
+		}`, server.patches["amb_v1"][0])
+	}
+
+	// Facets on nested fields are added in place
+	ts.Schema.FacetFields = []string{"keywords", "about.id"}
+	assert.NoError(ts.Init())
+	if assert.Len(server.patches["amb_v1"], 2) {
+		assert.JSONEq(`{
+			"fields": [{"name": "about.id", "type": "string[]", "facet": true, "optional": true}],
+			"metadata": {"schema_version": 3}
+		}`, server.patches["amb_v1"][1])
+	}
+}
+
+func TestInit_SortFields(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newSchemaServer(t)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+	assert.NoError(ts.Init())
+
+	// Sorting an existing field replaces it in place
+	ts.Schema.SortFields = []string{"name"}
+	assert.NoError(ts.Init())
+	if assert.Len(server.patches["amb_v1"], 1) {
+		assert.JSONEq(`{
+			"fields": [
+				{"name": "name", "drop": true},
+				{"name": "name", "type": "string", "sort": true}
+			],
+			"metadata": {"schema_version": 3}
+		}`, server.patches["amb_v1"][0])
+	}
+}
+
+func TestInit_OutdatedSchemaOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	var logs bytes.Buffer
+	server := newSchemaServer(t)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	assert.NoError(ts.Init())
+
+	// Another locale only takes effect with a reindex, the collection is used meanwhile
+	ts.Schema.Locales = map[string]string{"name": "de"}
+	assert.NoError(ts.Init())
+
+	assert.Empty(server.patches)
+	assert.Contains(logs.String(), "level=WARN")
+	assert.Contains(logs.String(), `field name has locale \"\" instead of \"de\"`)
+}
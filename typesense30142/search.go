@@ -0,0 +1,555 @@
+package typesense30142
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The NIP-50 search string is parsed with this grammar:
+//
+//	query   = or
+//	or      = and { "OR" and }
+//	and     = seq { "AND" seq }
+//	seq     = unary { unary }
+//	unary   = ( "NOT" | "-" ) unary | primary
+//	primary = "(" or ")" | field ":" value | word | phrase
+//	value   = word | phrase | range
+//	range   = ( ">" | ">=" | "<" | "<=" ) word | [ word ] ".." [ word ]
+//
+// Words and phrases are searched in the text fields, field:value pairs become
+// filters. Ranges are supported on the fields listed in rangeFields. The
+// sort:key extension selects one of the sortOrders, it may appear once at the
+// top level of the search. Within a sequence without explicit operators,
+// filters on the same base field are ORed, e.g. "about.id:a about.id:b",
+// everything else is ANDed.
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenPhrase
+	tokenField
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+// token is a lexical unit of a search string. Field tokens carry the field
+// name in text and the value in value.
+type token struct {
+	kind   tokenKind
+	text   string
+	value  string
+	phrase bool
+	offset int
+}
+
+// lexSearch splits a search string into tokens
+func lexSearch(input string) ([]token, error) {
+	var tokens []token
+
+	for pos := 0; pos < len(input); {
+		r, size := utf8.DecodeRuneInString(input[pos:])
+
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen, text: "(", offset: pos})
+			pos++
+
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose, text: ")", offset: pos})
+			pos++
+
+		case r == '"':
+			phrase, end, err := lexPhrase(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenPhrase, text: phrase, offset: pos})
+			pos = end
+
+		case r == '-' && pos+1 < len(input) && startsTerm(input[pos+1:]):
+			// A minus directly in front of a term negates it
+			tokens = append(tokens, token{kind: tokenNot, text: "-", offset: pos})
+			pos++
+
+		default:
+			start := pos
+			for pos < len(input) {
+				r, size := utf8.DecodeRuneInString(input[pos:])
+				if unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' {
+					break
+				}
+				pos += size
+			}
+			word := input[start:pos]
+
+			switch word {
+			case "AND":
+				tokens = append(tokens, token{kind: tokenAnd, text: word, offset: start})
+				continue
+			case "OR":
+				tokens = append(tokens, token{kind: tokenOr, text: word, offset: start})
+				continue
+			case "NOT":
+				tokens = append(tokens, token{kind: tokenNot, text: word, offset: start})
+				continue
+			}
+
+			field, value, isField := strings.Cut(word, ":")
+			if !isField {
+				tokens = append(tokens, token{kind: tokenWord, text: word, offset: start})
+				continue
+			}
+			if field == "" {
+				return nil, syntaxError(start, "missing field name before %q", ":"+value)
+			}
+
+			phrase := false
+			if value == "" && pos < len(input) && input[pos] == '"' {
+				// field:"quoted value"
+				var err error
+				value, pos, err = lexPhrase(input, pos)
+				if err != nil {
+					return nil, err
+				}
+				phrase = true
+			}
+			if value == "" {
+				return nil, syntaxError(start, "missing value for field %s", field)
+			}
+
+			tokens = append(tokens, token{kind: tokenField, text: field, value: value, phrase: phrase, offset: start})
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, offset: len(input)}), nil
+}
+
+// lexPhrase reads the phrase starting with the quote at pos and returns it
+// together with the position after the closing quote
+func lexPhrase(input string, pos int) (string, int, error) {
+	end := strings.IndexByte(input[pos+1:], '"')
+	if end < 0 {
+		return "", 0, syntaxError(pos, "unterminated quote")
+	}
+	phrase := input[pos+1 : pos+1+end]
+	if strings.TrimSpace(phrase) == "" {
+		return "", 0, syntaxError(pos, "empty quote")
+	}
+	return phrase, pos + end + 2, nil
+}
+
+// startsTerm reports whether a word, phrase or group starts at the beginning of s
+func startsTerm(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return !unicode.IsSpace(r) && r != ')' && r != '-'
+}
+
+// searchNode is a node of the syntax tree of a search string
+type searchNode interface {
+	offset() int
+}
+
+// termNode is a word or phrase searched in the text fields
+type termNode struct {
+	text   string
+	phrase bool
+	pos    int
+}
+
+// fieldNode matches the value against a field
+type fieldNode struct {
+	field string
+	value string
+	pos   int
+}
+
+// rangeNode matches the numeric shadow of a field against a range, the bounds
+// are inclusive and nil for open ranges
+type rangeNode struct {
+	field string
+	lower *int64
+	upper *int64
+	pos   int
+}
+
+// sortNode selects the order of the results
+type sortNode struct {
+	order string
+	pos   int
+}
+
+// notNode negates its operand
+type notNode struct {
+	operand searchNode
+	pos     int
+}
+
+// andNode matches if all operands match
+type andNode struct {
+	operands []searchNode
+	pos      int
+}
+
+// orNode matches if any operand matches
+type orNode struct {
+	operands []searchNode
+	pos      int
+}
+
+func (n *termNode) offset() int  { return n.pos }
+func (n *fieldNode) offset() int { return n.pos }
+func (n *rangeNode) offset() int { return n.pos }
+func (n *sortNode) offset() int  { return n.pos }
+func (n *notNode) offset() int   { return n.pos }
+func (n *andNode) offset() int   { return n.pos }
+func (n *orNode) offset() int    { return n.pos }
+
+// searchParser is a recursive descent parser over the tokens of a search string
+type searchParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *searchParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *searchParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *searchParser) parseOr() (searchNode, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []searchNode{first}
+	for p.peek().kind == tokenOr {
+		p.next()
+		operand, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return &orNode{operands: operands, pos: first.offset()}, nil
+}
+
+func (p *searchParser) parseAnd() (searchNode, error) {
+	first, err := p.parseSeq()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []searchNode{first}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		operand, err := p.parseSeq()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+
+	if len(operands) == 1 {
+		return first, nil
+	}
+	return &andNode{operands: operands, pos: first.offset()}, nil
+}
+
+// parseSeq parses operands joined without an operator
+func (p *searchParser) parseSeq() (searchNode, error) {
+	var operands []searchNode
+
+	for {
+		switch p.peek().kind {
+		case tokenEOF, tokenClose, tokenAnd, tokenOr:
+			if len(operands) == 0 {
+				t := p.peek()
+				if t.kind == tokenEOF {
+					return nil, syntaxError(t.offset, "expected a search term at the end")
+				}
+				return nil, syntaxError(t.offset, "expected a search term before %q", t.text)
+			}
+			if len(operands) == 1 {
+				return operands[0], nil
+			}
+			return &andNode{operands: groupFieldFilters(operands), pos: operands[0].offset()}, nil
+		}
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+}
+
+func (p *searchParser) parseUnary() (searchNode, error) {
+	if p.peek().kind == tokenNot {
+		t := p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand, pos: t.offset}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *searchParser) parsePrimary() (searchNode, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenWord:
+		return &termNode{text: t.text, pos: t.offset}, nil
+	case tokenPhrase:
+		return &termNode{text: t.text, phrase: true, pos: t.offset}, nil
+	case tokenField:
+		if t.text == sortField {
+			return parseSort(t)
+		}
+		if !validFieldName(t.text) {
+			return nil, syntaxError(t.offset, "invalid field name %q", t.text)
+		}
+		if !t.phrase && isRangeValue(t.text, t.value) {
+			return parseRange(t)
+		}
+		return &fieldNode{field: t.text, value: t.value, pos: t.offset}, nil
+	case tokenOpen:
+		group, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenClose {
+			return nil, syntaxError(t.offset, "unclosed parenthesis")
+		}
+		return group, nil
+	case tokenEOF:
+		return nil, syntaxError(t.offset, "expected a search term at the end")
+	}
+
+	return nil, syntaxError(t.offset, "unexpected %q", t.text)
+}
+
+// groupFieldFilters ORs the field filters of a sequence that share a base field,
+// e.g. about.id and about.prefLabel, at the position of the first of them
+func groupFieldFilters(operands []searchNode) []searchNode {
+	groups := map[string]*orNode{}
+	grouped := make([]searchNode, 0, len(operands))
+
+	for _, operand := range operands {
+		field, ok := operand.(*fieldNode)
+		if !ok {
+			grouped = append(grouped, operand)
+			continue
+		}
+
+		base, _, _ := strings.Cut(field.field, ".")
+		if group, ok := groups[base]; ok {
+			group.operands = append(group.operands, field)
+			continue
+		}
+
+		group := &orNode{operands: []searchNode{field}, pos: field.pos}
+		groups[base] = group
+		grouped = append(grouped, group)
+	}
+
+	// Unwrap filters that didn't get company
+	for i, operand := range grouped {
+		if group, ok := operand.(*orNode); ok && len(group.operands) == 1 {
+			grouped[i] = group.operands[0]
+		}
+	}
+
+	return grouped
+}
+
+// SearchQuery is a parsed NIP-50 search string
+type SearchQuery struct {
+	root searchNode
+}
+
+// ParseSearchQuery parses a search string of words, "quoted phrases" and
+// field:value filters, combined with AND, OR, NOT or -, and grouped with
+// parentheses. Strings that don't follow the grammar are rejected with a
+// SearchSyntaxError.
+func ParseSearchQuery(searchStr string) (SearchQuery, error) {
+	tokens, err := lexSearch(searchStr)
+	if err != nil {
+		return SearchQuery{}, err
+	}
+
+	// An empty search matches everything
+	if len(tokens) == 1 {
+		return SearchQuery{}, nil
+	}
+
+	parser := &searchParser{tokens: tokens}
+	root, err := parser.parseOr()
+	if err != nil {
+		return SearchQuery{}, err
+	}
+
+	if t := parser.peek(); t.kind != tokenEOF {
+		return SearchQuery{}, syntaxError(t.offset, "unexpected %q", t.text)
+	}
+
+	return SearchQuery{root: root}, nil
+}
+
+// BuildTypesenseQuery translates a parsed search into the text query q and the
+// filter_by and sort_by parameters. The words and phrases of the top level
+// conjunction make up q, where negated ones are excluded with a minus. Filters
+// can be combined freely, negated filters match documents whose field doesn't
+// equal the value. Words can't be part of an OR or a negated group, since
+// Typesense can't express that in q.
+func BuildTypesenseQuery(query SearchQuery) (string, map[string]string, error) {
+	params := make(map[string]string)
+	if query.root == nil {
+		return "", params, nil
+	}
+
+	operands := []searchNode{query.root}
+	if and, ok := query.root.(*andNode); ok {
+		operands = flattenAnd(and)
+	}
+
+	var terms, filters []string
+
+	for _, operand := range operands {
+		if term, ok := textTerm(operand, false); ok {
+			terms = append(terms, term)
+			continue
+		}
+
+		if sort, ok := operand.(*sortNode); ok {
+			if _, exists := params["sort_by"]; exists {
+				return "", nil, syntaxError(sort.pos, "more than one sort order")
+			}
+			params["sort_by"] = sortOrders[sort.order]
+			continue
+		}
+
+		expression, err := filterExpression(operand, false)
+		if err != nil {
+			return "", nil, err
+		}
+		filters = append(filters, expression)
+	}
+
+	if len(filters) > 0 {
+		params["filter_by"] = strings.Join(filters, " && ")
+	}
+
+	return strings.Join(terms, " "), params, nil
+}
+
+// flattenAnd lists the operands of nested conjunctions
+func flattenAnd(and *andNode) []searchNode {
+	var operands []searchNode
+	for _, operand := range and.operands {
+		if nested, ok := operand.(*andNode); ok {
+			operands = append(operands, flattenAnd(nested)...)
+		} else {
+			operands = append(operands, operand)
+		}
+	}
+	return operands
+}
+
+// textTerm translates a word or phrase, optionally negated, into a term of q
+func textTerm(node searchNode, negated bool) (string, bool) {
+	switch n := node.(type) {
+	case *termNode:
+		term := n.text
+		if n.phrase {
+			term = `"` + term + `"`
+		}
+		if negated {
+			term = "-" + term
+		}
+		return term, true
+	case *notNode:
+		if negated {
+			return "", false
+		}
+		return textTerm(n.operand, true)
+	}
+	return "", false
+}
+
+// filterExpression translates a node into a filter_by expression, pushing
+// negations down to the field filters
+func filterExpression(node searchNode, negated bool) (string, error) {
+	switch n := node.(type) {
+	case *fieldNode:
+		// The exact match is the complement of :!=, which has no token based
+		// counterpart in Typesense
+		op := ":="
+		if negated {
+			op = ":!="
+		}
+		return n.field + op + QuoteFilterValue(n.value), nil
+
+	case *rangeNode:
+		return n.filterExpression(negated), nil
+
+	case *notNode:
+		return filterExpression(n.operand, !negated)
+
+	case *andNode:
+		// NOT (a AND b) is (NOT a) OR (NOT b)
+		if negated {
+			return joinFilterExpressions(n.operands, negated, " || ")
+		}
+		return joinFilterExpressions(n.operands, negated, " && ")
+
+	case *orNode:
+		// NOT (a OR b) is (NOT a) AND (NOT b)
+		if negated {
+			return joinFilterExpressions(n.operands, negated, " && ")
+		}
+		return joinFilterExpressions(n.operands, negated, " || ")
+
+	case *sortNode:
+		return "", syntaxError(n.pos, "sort order can't be combined with OR or negated")
+
+	case *termNode:
+		return "", syntaxError(n.pos, "search words can't be combined with OR or negated in a group, use a field filter instead of %q", n.text)
+	}
+
+	return "", syntaxError(node.offset(), "unsupported expression")
+}
+
+func joinFilterExpressions(operands []searchNode, negated bool, operator string) (string, error) {
+	expressions := make([]string, 0, len(operands))
+	for _, operand := range operands {
+		expression, err := filterExpression(operand, negated)
+		if err != nil {
+			return "", err
+		}
+		expressions = append(expressions, expression)
+	}
+	return "(" + strings.Join(expressions, operator) + ")", nil
+}
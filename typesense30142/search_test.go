@@ -0,0 +1,186 @@
+package typesense30142
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildTypesenseQuery(t *testing.T) {
+	testCases := []struct {
+		search   string
+		q        string
+		filterBy string
+	}{
+		{search: "", q: ""},
+		{search: `Mathematik "Klasse 5"`, q: `Mathematik "Klasse 5"`},
+		{search: "Mathematik -Algebra", q: "Mathematik -Algebra"},
+		{search: `Mathematik NOT "Klasse 5"`, q: `Mathematik -"Klasse 5"`},
+		{search: "Mathematik keywords:Test", q: "Mathematik", filterBy: "keywords:=`Test`"},
+		{search: `name:"Bruchrechnung Teil 1"`, filterBy: "name:=`Bruchrechnung Teil 1`"},
+		{search: "-keywords:Test", filterBy: "keywords:!=`Test`"},
+		// A filter and its negation are complements, both match the exact value
+		{search: "keywords:test", filterBy: "keywords:=`test`"},
+		{search: "-keywords:test", filterBy: "keywords:!=`test`"},
+		{search: "NOT about.id:https://w3id.org/kim/hochschulfaechersystematik/n079", filterBy: "about.id:!=`https://w3id.org/kim/hochschulfaechersystematik/n079`"},
+		// Filters on the same base field are alternatives unless joined by AND
+		{search: "about.id:a about.prefLabel.de:b", filterBy: "(about.id:=`a` || about.prefLabel.de:=`b`)"},
+		{search: "about.id:a AND about.id:b", filterBy: "about.id:=`a` && about.id:=`b`"},
+		{search: "about.id:a inLanguage:de about.id:b", filterBy: "(about.id:=`a` || about.id:=`b`) && inLanguage:=`de`"},
+		{search: "keywords:a OR inLanguage:de", filterBy: "(keywords:=`a` || inLanguage:=`de`)"},
+		{search: "keywords:a OR inLanguage:de AND type:Course", filterBy: "(keywords:=`a` || (inLanguage:=`de` && type:=`Course`))"},
+		{search: "Bruch (keywords:a OR keywords:b) -(inLanguage:de OR inLanguage:en)", q: "Bruch", filterBy: "(keywords:=`a` || keywords:=`b`) && (inLanguage:!=`de` && inLanguage:!=`en`)"},
+		{search: "NOT (keywords:a type:Course)", filterBy: "(keywords:!=`a` || type:!=`Course`)"},
+		{search: "NOT NOT keywords:a", filterBy: "keywords:=`a`"},
+		// Ranges on the numeric shadows of dates and durations
+		{search: "datePublished:>=2023-01-01", filterBy: "datePublishedTimestamp:>=1672531200"},
+		{search: "datePublished:>2023-01-01", filterBy: "datePublishedTimestamp:>=1672617600"},
+		{search: "dateModified:<2023", filterBy: "dateModifiedTimestamp:<=1672531199"},
+		{search: "dateCreated:<=2023", filterBy: "dateCreatedTimestamp:<=1704067199"},
+		{search: "datePublished:2023-01..2023-02", filterBy: "datePublishedTimestamp:[1672531200..1677628799]"},
+		{search: "datePublished:2023..", filterBy: "datePublishedTimestamp:>=1672531200"},
+		{search: "duration:<PT30M", filterBy: "durationSeconds:<=1799"},
+		{search: "duration:PT10M..PT1H", filterBy: "durationSeconds:[600..3600]"},
+		{search: "-duration:PT10M..PT1H", filterBy: "(durationSeconds:<600 || durationSeconds:>3600)"},
+		{search: "NOT duration:>=PT1H", filterBy: "durationSeconds:<3600"},
+		{search: "datePublished:>2020 datePublished:<2023", filterBy: "datePublishedTimestamp:>=1609459200 && datePublishedTimestamp:<=1672531199"},
+		{search: "datePublished:2023-01-01", filterBy: "datePublished:=`2023-01-01`"},
+		{search: "isBasedOn.id:https://example.org/a/../b", filterBy: "isBasedOn.id:=`https://example.org/a/../b`"},
+		// Other fields match comparison operators as part of the value
+		{search: "keywords:<html>", filterBy: "keywords:=`<html>`"},
+		{search: "Bruch name:>Intro", q: "Bruch", filterBy: "name:=`>Intro`"},
+		// A minus inside a word or on its own isn't an operator
+		{search: "e-learning - Kurs", q: "e-learning - Kurs"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.search, func(t *testing.T) {
+			assert := assert.New(t)
+
+			query, err := ParseSearchQuery(tc.search)
+			assert.NoError(err)
+
+			q, params, err := BuildTypesenseQuery(query)
+			assert.NoError(err)
+			assert.Equal(tc.q, q)
+			assert.Equal(tc.filterBy, params["filter_by"])
+		})
+	}
+}
+
+func TestParseSearchQuery_SyntaxErrors(t *testing.T) {
+	testCases := []struct {
+		search string
+		offset int
+	}{
+		{search: `Mathematik "Klasse 5`, offset: 11},
+		{search: "(keywords:a", offset: 0},
+		{search: "keywords:a)", offset: 10},
+		{search: "keywords:a OR", offset: 13},
+		{search: "AND keywords:a", offset: 0},
+		{search: "keywords:a ()", offset: 12},
+		{search: "keywords: Test", offset: 0},
+		{search: ":Test", offset: 0},
+		{search: "Bruch key-word:Test", offset: 6},
+		{search: "NOT", offset: 3},
+		{search: "datePublished:>yesterday", offset: 0},
+		{search: "duration:<30", offset: 0},
+		{search: "datePublished:..", offset: 0},
+		{search: "datePublished:2024..2023", offset: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.search, func(t *testing.T) {
+			assert := assert.New(t)
+
+			_, err := ParseSearchQuery(tc.search)
+			assert.ErrorIs(err, ErrInvalidSearch)
+
+			var syntaxErr *SearchSyntaxError
+			if assert.True(errors.As(err, &syntaxErr)) {
+				assert.Equal(tc.offset, syntaxErr.Offset)
+			}
+		})
+	}
+}
+
+func TestBuildTypesenseQuery_UnsupportedTerms(t *testing.T) {
+	assert := assert.New(t)
+
+	// Typesense can't combine text search with filters by OR
+	for _, search := range []string{"Mathematik OR keywords:a", "-(Mathematik keywords:a)", "NOT -Mathematik"} {
+		query, err := ParseSearchQuery(search)
+		assert.NoError(err, search)
+
+		_, _, err = BuildTypesenseQuery(query)
+		assert.ErrorIs(err, ErrInvalidSearch, search)
+	}
+}
+
+func TestQueryEvents_InvalidSearch(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s", r.URL)
+	}))
+	defer server.Close()
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	_, err := ts.QueryEvents(context.Background(), nostr.Filter{Search: "(keywords:a"})
+	assert.ErrorIs(err, ErrInvalidSearch)
+}
+
+func TestBuildQuery_Sort(t *testing.T) {
+	testCases := []struct {
+		search string
+		q      string
+		sortBy string
+	}{
+		{search: "", q: "*", sortBy: "eventCreatedAt:desc"},
+		{search: "Mathematik", q: "Mathematik"},
+		{search: "sort:oldest", q: "*", sortBy: "eventCreatedAt:asc"},
+		{search: "Mathematik sort:newest", q: "Mathematik", sortBy: "eventCreatedAt:desc"},
+		{search: "sort:title inLanguage:de", q: "*", sortBy: "nameSort(missing_values: last):asc,eventCreatedAt:desc"},
+		{search: "(keywords:a OR keywords:b) sort:modified", q: "*", sortBy: "dateModifiedTimestamp(missing_values: last):desc,eventCreatedAt:desc"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.search, func(t *testing.T) {
+			assert := assert.New(t)
+
+			query, err := BuildQuery(nostr.Filter{Search: tc.search})
+			assert.NoError(err)
+			assert.Equal(tc.q, query.Q)
+			assert.Equal(tc.sortBy, query.Params["sort_by"])
+		})
+	}
+}
+
+func TestBuildQuery_InvalidSort(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, search := range []string{"sort:random", `sort:"title"`, "sort:newest sort:title", "NOT sort:newest", "keywords:a OR sort:title"} {
+		_, err := BuildQuery(nostr.Filter{Search: search})
+		assert.ErrorIs(err, ErrInvalidSearch, search)
+	}
+}
+
+func TestSortKey(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("ubungen zur bruchrechnung", sortKey(" Übungen zur Bruchrechnung"))
+	assert.Equal("strasse", sortKey("Straße"))
+}
+
+func TestBuildQuery_ExcludesShadowFields(t *testing.T) {
+	assert := assert.New(t)
+
+	query, err := BuildQuery(nostr.Filter{Search: "Mathematik"})
+	assert.NoError(err)
+	assert.Equal("nameSort,dateCreatedTimestamp,datePublishedTimestamp,dateModifiedTimestamp,durationSeconds", query.Params["exclude_fields"])
+}
@@ -0,0 +1,49 @@
+package typesense30142
+
+import (
+	"maps"
+	"slices"
+	"strings"
+)
+
+// sortOrders maps the keys of the sort: search extension to Typesense sort_by
+// expressions. Only fields that are sortable in the AMB schema may appear here.
+var sortOrders = map[string]string{
+	"relevance": "_text_match:desc,eventCreatedAt:desc",
+	"newest":    "eventCreatedAt:desc",
+	"oldest":    "eventCreatedAt:asc",
+	"published": "datePublishedTimestamp(missing_values: last):desc,eventCreatedAt:desc",
+	"modified":  "dateModifiedTimestamp(missing_values: last):desc,eventCreatedAt:desc",
+	"title":     "nameSort(missing_values: last):asc,eventCreatedAt:desc",
+}
+
+// sortField is the name of the search extension selecting the sort order
+const sortField = "sort"
+
+// sortKeyReplacer folds letters that would otherwise sort after z
+var sortKeyReplacer = strings.NewReplacer(
+	"ä", "a", "ö", "o", "ü", "u", "ß", "ss",
+	"à", "a", "á", "a", "â", "a", "é", "e", "è", "e", "ê", "e",
+	"í", "i", "ì", "i", "î", "i", "ó", "o", "ò", "o", "ô", "o",
+	"ú", "u", "ù", "u", "û", "u", "ç", "c", "ñ", "n",
+)
+
+// sortKey normalizes a title for sorting, so that case and common diacritics
+// don't change its position
+func sortKey(title string) string {
+	return sortKeyReplacer.Replace(strings.ToLower(strings.TrimSpace(title)))
+}
+
+// parseSort validates the key of a sort: token
+func parseSort(t token) (searchNode, error) {
+	if t.phrase {
+		return nil, syntaxError(t.offset, "sort order can't be quoted")
+	}
+
+	if _, ok := sortOrders[t.value]; !ok {
+		keys := slices.Sorted(maps.Keys(sortOrders))
+		return nil, syntaxError(t.offset, "unknown sort order %q, expected one of %s", t.value, strings.Join(keys, ", "))
+	}
+
+	return &sortNode{order: t.value, pos: t.offset}, nil
+}
@@ -0,0 +1,209 @@
+package typesense30142
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// TombstoneEvent marks a single deleted event
+	TombstoneEvent = "e"
+	// TombstoneAddress marks all versions of an address up to DeletedUntil as deleted
+	TombstoneAddress = "a"
+)
+
+// Tombstone records a deleted event or address, so that rebroadcasts of the
+// deleted events are refused by SaveEvent and ReplaceEvent
+type Tombstone struct {
+	// Hashed event id and author for event tombstones, hashed address for address tombstones
+	ID string `json:"id"`
+	// TombstoneEvent or TombstoneAddress
+	Type string `json:"type"`
+	// The deleted event id or address (kind:pubkey:d)
+	Target string `json:"target"`
+	// Author of the deleted events, tombstones never cover events of other authors
+	PubKey string `json:"pubkey"`
+	// Versions of an address created up to this time are deleted
+	DeletedUntil nostr.Timestamp `json:"deletedUntil"`
+	// When the tombstone was recorded
+	DeletedAt nostr.Timestamp `json:"deletedAt"`
+}
+
+// tombstoneCollection returns the name of the collection holding the tombstones
+func (ts *TSBackend) tombstoneCollection() string {
+	if ts.TombstoneCollectionName != "" {
+		return ts.TombstoneCollectionName
+	}
+	return ts.CollectionName + "_tombstones"
+}
+
+// tombstoneCollectionSchema returns the schema of the collection holding the tombstones
+func tombstoneCollectionSchema(name string) CollectionSchema {
+	return CollectionSchema{
+		Name: name,
+		Fields: []Field{
+			{Name: "id", Type: "string"},
+			{Name: "type", Type: "string"},
+			{Name: "target", Type: "string"},
+			{Name: "pubkey", Type: "string"},
+			{Name: "deletedUntil", Type: "int64"},
+			{Name: "deletedAt", Type: "int64"},
+		},
+		DefaultSortingField: "deletedAt",
+		Metadata:            schemaVersionMetadata(tombstoneSchemaVersion),
+	}
+}
+
+// eventTombstone creates a tombstone for a single deleted event
+func eventTombstone(eventID string, pubkey string) *Tombstone {
+	return &Tombstone{
+		ID:        eventTombstoneID(eventID, pubkey),
+		Type:      TombstoneEvent,
+		Target:    eventID,
+		PubKey:    pubkey,
+		DeletedAt: nostr.Now(),
+	}
+}
+
+// addressTombstone creates a tombstone for all versions of an address created up to deletedUntil
+func addressTombstone(kind int, pubkey string, d string, deletedUntil nostr.Timestamp) *Tombstone {
+	return &Tombstone{
+		ID:           addressID(kind, pubkey, d),
+		Type:         TombstoneAddress,
+		Target:       fmt.Sprintf("%d:%s:%s", kind, pubkey, d),
+		PubKey:       pubkey,
+		DeletedUntil: deletedUntil,
+		DeletedAt:    nostr.Now(),
+	}
+}
+
+// eventTombstoneID derives the id of an event tombstone. The author is part of
+// the id, so deletion requests of other authors can't overwrite the tombstone.
+func eventTombstoneID(eventID string, pubkey string) string {
+	hash := sha256.Sum256([]byte(eventID + ":" + pubkey))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkTombstones returns ErrTombstoned if the event is covered by a tombstone
+func (ts *TSBackend) checkTombstones(ctx context.Context, event *nostr.Event) error {
+	tombstone, err := ts.getTombstone(ctx, eventTombstoneID(event.ID, event.PubKey))
+	if err != nil {
+		return err
+	}
+	if tombstone != nil && tombstone.PubKey == event.PubKey {
+		ts.metrics().CountEvents(EventRejected, 1)
+		return ErrTombstoned
+	}
+
+	if !nostr.IsReplaceableKind(event.Kind) && !nostr.IsAddressableKind(event.Kind) {
+		return nil
+	}
+
+	tombstone, err = ts.getTombstone(ctx, addressID(event.Kind, event.PubKey, event.Tags.GetD()))
+	if err != nil {
+		return err
+	}
+	if tombstone != nil && tombstone.PubKey == event.PubKey && event.CreatedAt <= tombstone.DeletedUntil {
+		ts.metrics().CountEvents(EventRejected, 1)
+		return ErrTombstoned
+	}
+
+	return nil
+}
+
+// putTombstone stores the tombstone, an address tombstone never moves DeletedUntil backwards
+func (ts *TSBackend) putTombstone(ctx context.Context, tombstone *Tombstone) error {
+	if tombstone.Type == TombstoneAddress {
+		stored, err := ts.getTombstone(ctx, tombstone.ID)
+		if err != nil {
+			return err
+		}
+		if stored != nil && stored.DeletedUntil >= tombstone.DeletedUntil {
+			return nil
+		}
+	}
+
+	path := ts.collectionDocumentsPath(ts.tombstoneCollection(), "", url.Values{"action": {"upsert"}})
+	jsonData, err := json.Marshal(tombstone)
+	if err != nil {
+		return err
+	}
+
+	resp, body, err := ts.makehttpRequest(ctx, opUpsert, path, http.MethodPost, jsonData)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to store tombstone: %w", newTypesenseError(resp, body))
+	}
+
+	return nil
+}
+
+// getTombstone fetches a tombstone by id, nil if there is none
+func (ts *TSBackend) getTombstone(ctx context.Context, id string) (*Tombstone, error) {
+	path := ts.collectionDocumentsPath(ts.tombstoneCollection(), "/"+url.PathEscape(id), nil)
+
+	resp, body, err := ts.makehttpRequest(ctx, opGet, path, http.MethodGet, nil)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch tombstone: %w", newTypesenseError(resp, body))
+	}
+
+	var tombstone Tombstone
+	if err := json.Unmarshal(body, &tombstone); err != nil {
+		return nil, fmt.Errorf("error parsing tombstone: %v", err)
+	}
+
+	return &tombstone, nil
+}
+
+// ListTombstones returns all recorded tombstones
+func (ts *TSBackend) ListTombstones(ctx context.Context) ([]Tombstone, error) {
+	tombstones := []Tombstone{}
+
+	err := ts.exportDocuments(ctx, opExport, ts.tombstoneCollection(), nil, func(line []byte) error {
+		var tombstone Tombstone
+		if err := json.Unmarshal(line, &tombstone); err != nil {
+			return fmt.Errorf("error parsing tombstone: %v", err)
+		}
+		tombstones = append(tombstones, tombstone)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tombstones, nil
+}
+
+// LiftTombstone removes a tombstone, so that the events it covered can be indexed again
+func (ts *TSBackend) LiftTombstone(ctx context.Context, id string) error {
+	path := ts.collectionDocumentsPath(ts.tombstoneCollection(), "/"+url.PathEscape(id), nil)
+
+	resp, body, err := ts.makehttpRequest(ctx, opDelete, path, http.MethodDelete, nil)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to lift tombstone: %w", newTypesenseError(resp, body))
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package typesense30142
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstones_DeleteEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	ctx := context.Background()
+	sk := nostr.GeneratePrivateKey()
+
+	event := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	event.Sign(sk)
+	older := &nostr.Event{Kind: 30142, CreatedAt: 900, Tags: nostr.Tags{{"d", "resource"}}}
+	older.Sign(sk)
+	newer := &nostr.Event{Kind: 30142, CreatedAt: 1100, Tags: nostr.Tags{{"d", "resource"}}}
+	newer.Sign(sk)
+
+	assert.NoError(ts.ReplaceEvent(ctx, event))
+	assert.NoError(ts.DeleteEvent(ctx, event))
+
+	// rebroadcasts of the deleted version and older versions are refused
+	assert.ErrorIs(ts.ReplaceEvent(ctx, event), ErrTombstoned)
+	assert.ErrorIs(ts.SaveEvent(ctx, event), ErrTombstoned)
+	assert.ErrorIs(ts.ReplaceEvent(ctx, older), ErrTombstoned)
+
+	// a newer version may be published again
+	assert.NoError(ts.ReplaceEvent(ctx, newer))
+}
+
+func TestTombstones_ProcessDeletion(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	ts := fake.backend()
+	ctx := context.Background()
+
+	sk := nostr.GeneratePrivateKey()
+	author, _ := nostr.GetPublicKey(sk)
+	mallory := nostr.GeneratePrivateKey()
+
+	regular := &nostr.Event{Kind: 1, CreatedAt: 1000, Content: "hello"}
+	regular.Sign(sk)
+	resource := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	resource.Sign(sk)
+
+	// deletions by other authors never block events
+	foreign := &nostr.Event{Kind: nostr.KindDeletion, CreatedAt: 2000, Tags: nostr.Tags{
+		{"e", regular.ID},
+		{"a", "30142:" + author + ":resource"},
+	}}
+	foreign.Sign(mallory)
+	_, err := ts.ProcessDeletion(ctx, foreign)
+	assert.NoError(err)
+	assert.NoError(ts.SaveEvent(ctx, regular))
+	assert.NoError(ts.ReplaceEvent(ctx, resource))
+
+	deletion := &nostr.Event{Kind: nostr.KindDeletion, CreatedAt: 2000, Tags: nostr.Tags{
+		{"e", regular.ID},
+		{"a", "30142:" + author + ":resource"},
+	}}
+	deletion.Sign(sk)
+	_, err = ts.ProcessDeletion(ctx, deletion)
+	assert.NoError(err)
+
+	assert.ErrorIs(ts.SaveEvent(ctx, regular), ErrTombstoned)
+	assert.ErrorIs(ts.ReplaceEvent(ctx, resource), ErrTombstoned)
+
+	tombstones, err := ts.ListTombstones(ctx)
+	assert.NoError(err)
+	assert.Len(tombstones, 3)
+
+	// lifting the address tombstone allows republishing the resource
+	for _, tombstone := range tombstones {
+		if tombstone.Type == TombstoneAddress && tombstone.PubKey == author {
+			assert.Equal("30142:"+author+":resource", tombstone.Target)
+			assert.Equal(nostr.Timestamp(2000), tombstone.DeletedUntil)
+			assert.NoError(ts.LiftTombstone(ctx, tombstone.ID))
+		}
+	}
+	assert.NoError(ts.ReplaceEvent(ctx, resource))
+	assert.Error(ts.LiftTombstone(ctx, "unknown"))
+}
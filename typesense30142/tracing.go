@@ -0,0 +1,89 @@
+package typesense30142
+
+import (
+	"context"
+	"sort"
+
+	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/edufeed-org/eventstore/typesense30142"
+
+// Span attribute keys
+const (
+	attrCollection   = attribute.Key("db.collection.name")
+	attrResultCount  = attribute.Key("typesense.result_count")
+	attrOperation    = attribute.Key("typesense.operation")
+	attrAttempt      = attribute.Key("typesense.attempt")
+	attrQuery        = attribute.Key("typesense.q")
+	attrFilterBy     = attribute.Key("typesense.filter_by")
+	attrHTTPMethod   = attribute.Key("http.request.method")
+	attrHTTPStatus   = attribute.Key("http.response.status_code")
+	attrServer       = attribute.Key("server.address")
+	attrFilterIDs    = attribute.Key("nostr.filter.ids")
+	attrFilterAuthor = attribute.Key("nostr.filter.authors")
+	attrFilterKinds  = attribute.Key("nostr.filter.kinds")
+	attrFilterTags   = attribute.Key("nostr.filter.tags")
+	attrFilterSearch = attribute.Key("nostr.filter.search")
+	attrFilterLimit  = attribute.Key("nostr.filter.limit")
+	attrEventID      = attribute.Key("nostr.event.id")
+	attrEventKind    = attribute.Key("nostr.event.kind")
+	attrEventPubKey  = attribute.Key("nostr.event.pubkey")
+	attrEventD       = attribute.Key("nostr.event.d")
+)
+
+// tracer returns the tracer of the configured provider or of the global one
+func (ts *TSBackend) tracer() trace.Tracer {
+	provider := ts.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// startSpan starts a span of the store's tracer as a child of the span in ctx
+func (ts *TSBackend) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attrCollection.String(ts.CollectionName))
+	return ts.tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan marks the span as failed if err is set and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// filterAttrs summarizes a nostr filter without listing every id and author
+func filterAttrs(filter nostr.Filter) []attribute.KeyValue {
+	tagNames := make([]string, 0, len(filter.Tags))
+	for tagName := range filter.Tags {
+		tagNames = append(tagNames, tagName)
+	}
+	sort.Strings(tagNames)
+
+	return []attribute.KeyValue{
+		attrFilterIDs.Int(len(filter.IDs)),
+		attrFilterAuthor.Int(len(filter.Authors)),
+		attrFilterKinds.IntSlice(filter.Kinds),
+		attrFilterTags.StringSlice(tagNames),
+		attrFilterSearch.String(filter.Search),
+		attrFilterLimit.Int(filter.Limit),
+	}
+}
+
+// eventSpanAttrs describes an event in spans
+func eventSpanAttrs(event *nostr.Event) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attrEventID.String(event.ID),
+		attrEventKind.Int(event.Kind),
+		attrEventPubKey.String(event.PubKey),
+		attrEventD.String(event.Tags.GetD()),
+	}
+}
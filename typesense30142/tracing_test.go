@@ -0,0 +1,150 @@
+package typesense30142
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTracerProvider(t *testing.T) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return provider, recorder
+}
+
+// spansByName indexes the ended spans by their name
+func spansByName(recorder *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	return spans
+}
+
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing_QueryEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	event := createTestEvent(nostr.Tags{{"d", "resource-1"}})
+	raw, _ := eventToStringifiedJSON(event)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"found": 1, "page": 1, "hits": []map[string]any{
+			{"document": map[string]any{"eventRaw": raw}},
+		}})
+	}))
+	defer server.Close()
+
+	provider, recorder := newTestTracerProvider(t)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", TracerProvider: provider}
+
+	ch, err := ts.QueryEvents(context.Background(), nostr.Filter{Kinds: []int{30142}, Search: "Mathematik"})
+	assert.NoError(err)
+	for range ch {
+	}
+
+	// The span of QueryEvents ends after the channel was closed
+	assert.Eventually(func() bool {
+		_, ok := spansByName(recorder)["typesense.QueryEvents"]
+		return ok
+	}, time.Second, time.Millisecond)
+
+	spans := spansByName(recorder)
+	query := spans["typesense.QueryEvents"]
+	assert.Equal("amb", spanAttr(query, attrCollection).AsString())
+	assert.Equal("Mathematik", spanAttr(query, attrFilterSearch).AsString())
+	assert.Equal([]int64{30142}, spanAttr(query, attrFilterKinds).AsInt64Slice())
+	assert.Equal(int64(1), spanAttr(query, attrResultCount).AsInt64())
+
+	for _, name := range []string{"typesense.ParseSearchQuery", "typesense.BuildTypesenseQuery", "typesense.search", "typesense.DecodeEvents"} {
+		if assert.Contains(spans, name) {
+			assert.Equal(query.SpanContext().SpanID(), spans[name].Parent().SpanID(), name)
+			assert.Equal(query.SpanContext().TraceID(), spans[name].SpanContext().TraceID(), name)
+		}
+	}
+
+	request := spans["typesense.search"]
+	assert.Equal(int64(http.StatusOK), spanAttr(request, attrHTTPStatus).AsInt64())
+	assert.Equal(http.MethodGet, spanAttr(request, attrHTTPMethod).AsString())
+	assert.Equal("Mathematik", spanAttr(spans["typesense.BuildTypesenseQuery"], attrQuery).AsString())
+}
+
+func TestTracing_ReplaceEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	provider, recorder := newTestTracerProvider(t)
+	ts := fake.backend()
+	ts.TracerProvider = provider
+	sk := nostr.GeneratePrivateKey()
+	ctx := context.Background()
+
+	newer := &nostr.Event{Kind: 30142, CreatedAt: 2000, Tags: nostr.Tags{{"d", "resource"}}}
+	newer.Sign(sk)
+	older := &nostr.Event{Kind: 30142, CreatedAt: 1000, Tags: nostr.Tags{{"d", "resource"}}}
+	older.Sign(sk)
+
+	assert.NoError(ts.ReplaceEvent(ctx, newer))
+	assert.ErrorIs(ts.ReplaceEvent(ctx, older), ErrOlderEvent)
+
+	var replaces []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "typesense.ReplaceEvent" {
+			replaces = append(replaces, span)
+		}
+	}
+
+	if assert.Len(replaces, 2) {
+		assert.Equal(newer.ID, spanAttr(replaces[0], attrEventID).AsString())
+		assert.Equal("resource", spanAttr(replaces[0], attrEventD).AsString())
+		assert.Equal(codes.Unset, replaces[0].Status().Code)
+		assert.Equal(codes.Error, replaces[1].Status().Code)
+	}
+
+	// Requests are children of the replacement
+	upserts := 0
+	for _, span := range recorder.Ended() {
+		if span.Name() == "typesense.upsert" {
+			upserts++
+			assert.Equal(replaces[0].SpanContext().SpanID(), span.Parent().SpanID())
+		}
+	}
+	assert.Equal(1, upserts)
+}
+
+func TestTracing_ServerError(t *testing.T) {
+	assert := assert.New(t)
+
+	server, _ := flakyServer(t, 1, http.StatusServiceUnavailable, nil)
+	provider, recorder := newTestTracerProvider(t)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", TracerProvider: provider, Retry: RetryPolicy{BaseDelay: time.Millisecond}}
+
+	_, err := ts.SearchResources(context.Background(), nostr.Filter{})
+	assert.NoError(err)
+
+	var statuses []codes.Code
+	for _, span := range recorder.Ended() {
+		if span.Name() == "typesense.search" {
+			statuses = append(statuses, span.Status().Code)
+		}
+	}
+	assert.Equal([]codes.Code{codes.Error, codes.Unset}, statuses)
+}
@@ -137,63 +137,73 @@ type License struct {
 
 // NostrMetadata contains Nostr-specific metadata
 type NostrMetadata struct {
-	EventID        string          `json:"eventID"`
-	EventKind      int             `json:"eventKind"`
-	EventPubKey    string          `json:"eventPubKey"`
-	EventSig       string          `json:"eventSignature"`
-	EventCreatedAt nostr.Timestamp `json:"eventCreatedAt"`
-	EventContent   string          `json:"eventContent"`
-	EventRaw       string          `json:"eventRaw"`
+	EventID        string          `json:"eventID" typesense:""`
+	EventKind      int             `json:"eventKind" typesense:"type=int32"`
+	EventPubKey    string          `json:"eventPubKey" typesense:""`
+	EventSig       string          `json:"eventSignature" typesense:""`
+	EventCreatedAt nostr.Timestamp `json:"eventCreatedAt" typesense:""`
+	EventContent   string          `json:"eventContent" typesense:""`
+	EventRaw       string          `json:"eventRaw" typesense:""`
 }
 
-// AMBMetadata represents the full metadata structure
+// AMBMetadata represents the full metadata structure. The typesense struct tags
+// describe the fields of the Typesense collection, see schemaFields.
 type AMBMetadata struct {
-	// Event ID
-	ID string `json:"id"`
+	// Typesense document ID, derived from the event address for addressable events
+	ID string `json:"id" typesense:""`
 	// Document ID
-	D           string     `json:"d"`
-	Type        []string   `json:"type,omitempty"`
-	Name        string     `json:"name"`
-	Description string     `json:"description,omitempty"`
-	About       []*About   `json:"about,omitempty"`
-	Keywords    []string   `json:"keywords,omitempty"`
-	InLanguage  []string   `json:"inLanguage,omitempty"`
-	Image       string     `json:"image,omitempty"`
-	Trailer     []*Trailer `json:"trailer,omitempty"`
+	D           string     `json:"d" typesense:""`
+	Type        []string   `json:"type" typesense:""`
+	Name        string     `json:"name" typesense:""`
+	Description string     `json:"description,omitempty" typesense:"optional"`
+	About       []*About   `json:"about,omitempty" typesense:"optional"`
+	Keywords    []string   `json:"keywords,omitempty" typesense:"optional"`
+	InLanguage  []string   `json:"inLanguage,omitempty" typesense:"optional"`
+	Image       string     `json:"image,omitempty" typesense:"optional"`
+	Trailer     []*Trailer `json:"trailer,omitempty" typesense:"optional"`
 
 	// Provenience
-	Creator       []*Creator     `json:"creator,omitempty"`
-	Contributor   []*Contributor `json:"contributor,omitempty"`
-	DateCreated   string         `json:"dateCreated,omitempty"`
-	DatePublished string         `json:"datePublished,omitempty"`
-	DateModified  string         `json:"dateModified,omitempty"`
-	Publisher     []*Publisher   `json:"publisher,omitempty"`
-	Funder        []*Funder      `json:"funder,omitempty"`
+	Creator       []*Creator     `json:"creator,omitempty" typesense:"optional"`
+	Contributor   []*Contributor `json:"contributor,omitempty" typesense:"optional"`
+	DateCreated   string         `json:"dateCreated,omitempty" typesense:"optional"`
+	DatePublished string         `json:"datePublished,omitempty" typesense:"optional"`
+	DateModified  string         `json:"dateModified,omitempty" typesense:"optional"`
+	Publisher     []*Publisher   `json:"publisher,omitempty" typesense:"optional"`
+	Funder        []*Funder      `json:"funder,omitempty" typesense:"optional"`
 
 	// Costs and Rights
-	IsAccessibleForFree bool                `json:"isAccessibleForFree,omitempty"`
-	License             *License            `json:"license,omitempty"`
-	ConditionsOfAccess  *ConditionsOfAccess `json:"conditionsOfAccess,omitempty"`
+	IsAccessibleForFree bool                `json:"isAccessibleForFree,omitempty" typesense:"optional"`
+	License             *License            `json:"license,omitempty" typesense:"optional"`
+	ConditionsOfAccess  *ConditionsOfAccess `json:"conditionsOfAccess,omitempty" typesense:"optional"`
 
 	// Educational metadata
-	LearningResourceType []*LearningResourceType `json:"learningResourceType,omitempty"`
-	Audience             []*Audience             `json:"audience,omitempty"`
-	Teaches              []*Teaches              `json:"teaches,omitempty"`
-	Assesses             []*Assesses             `json:"assesses,omitempty"`
-	CompetencyRequired   []*CompetencyRequired   `json:"competencyRequired,omitempty"`
-	EducationalLevel     []*EducationalLevel     `json:"educationalLevel,omitempty"`
-	InteractivityType    *InteractivityType      `json:"interactivityType,omitempty"`
+	LearningResourceType []*LearningResourceType `json:"learningResourceType,omitempty" typesense:"optional"`
+	Audience             []*Audience             `json:"audience,omitempty" typesense:"optional"`
+	Teaches              []*Teaches              `json:"teaches,omitempty" typesense:"optional"`
+	Assesses             []*Assesses             `json:"assesses,omitempty" typesense:"optional"`
+	CompetencyRequired   []*CompetencyRequired   `json:"competencyRequired,omitempty" typesense:"optional"`
+	EducationalLevel     []*EducationalLevel     `json:"educationalLevel,omitempty" typesense:"optional"`
+	InteractivityType    *InteractivityType      `json:"interactivityType,omitempty" typesense:"optional"`
 
 	// Relation
-	IsBasedOn []*IsBasedOn `json:"isBasedOn,omitempty"`
-	IsPartOf  []*IsPartOf  `json:"isPartOf,omitempty"`
-	HasPart   []*HasPart   `json:"hasPart,omitempty"`
+	IsBasedOn []*IsBasedOn `json:"isBasedOn,omitempty" typesense:"optional"`
+	IsPartOf  []*IsPartOf  `json:"isPartOf,omitempty" typesense:"optional"`
+	HasPart   []*HasPart   `json:"hasPart,omitempty" typesense:"optional"`
 
 	// Technical
-	Duration string `json:"duration,omitempty"`
+	Duration string `json:"duration,omitempty" typesense:"optional"`
 	// TODO Encoding  ``
 	// TODO Caption
 
+	// Shadow fields derived by setShadowFields for sorting and range searches.
+	// They are internal to the index, not part of the AMB metadata of the
+	// event, and left out of search results, see shadowFields.
+	NameSort               string `json:"nameSort,omitempty" typesense:"optional,sort"`
+	DateCreatedTimestamp   *int64 `json:"dateCreatedTimestamp,omitempty" typesense:"optional"`
+	DatePublishedTimestamp *int64 `json:"datePublishedTimestamp,omitempty" typesense:"optional"`
+	DateModifiedTimestamp  *int64 `json:"dateModifiedTimestamp,omitempty" typesense:"optional"`
+	DurationSeconds        *int64 `json:"durationSeconds,omitempty" typesense:"optional"`
+
 	// Nostr integration
 	NostrMetadata `json:",inline"`
 }
@@ -2,13 +2,20 @@ package typesense30142
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
 
-	"github.com/nbd-wtf/go-nostr"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type CollectionSchema struct {
@@ -16,6 +23,8 @@ type CollectionSchema struct {
 	Fields              []Field `json:"fields"`
 	DefaultSortingField string  `json:"default_sorting_field"`
 	EnableNestedFields  bool    `json:"enable_nested_fields"`
+	// Metadata records the schema version, see Version
+	Metadata map[string]any `json:"metadata,omitempty"`
 }
 
 type Field struct {
@@ -23,6 +32,12 @@ type Field struct {
 	Type     string `json:"type"`
 	Facet    bool   `json:"facet,omitempty"`
 	Optional bool   `json:"optional,omitempty"`
+	// Index and Sort are left to the defaults of Typesense when nil
+	Index  *bool  `json:"index,omitempty"`
+	Sort   *bool  `json:"sort,omitempty"`
+	Locale string `json:"locale,omitempty"`
+	Infix  bool   `json:"infix,omitempty"`
+	Stem   bool   `json:"stem,omitempty"`
 }
 
 type SearchResponse struct {
@@ -32,156 +47,416 @@ type SearchResponse struct {
 	Request map[string]any   `json:"request"`
 }
 
-// CheckOrCreateCollection checks if a collection exists and creates it if it doesn't
+// CheckOrCreateCollection checks if the AMB and tombstone collections exist and creates them if they don't.
+// A new AMB collection is versioned and CollectionName becomes an alias of it, see Reindex.
 func (ts *TSBackend) CheckOrCreateCollection() error {
-	exists, err := ts.collectionExists()
+	ctx := context.Background()
+
+	if err := ts.checkOrCreateAMBCollection(ctx); err != nil {
+		return err
+	}
+
+	return ts.checkOrCreateCollection(ctx, tombstoneCollectionSchema(ts.tombstoneCollection()))
+}
+
+// checkOrCreateAMBCollection resolves the CollectionName alias and checks the
+// collection behind it. Collections created before CollectionName became an
+// alias are used directly until the next Reindex.
+func (ts *TSBackend) checkOrCreateAMBCollection(ctx context.Context) error {
+	// Typesense resolves a collection before an alias of the same name
+	live, err := ts.legacyCollection(ctx)
 	if err != nil {
-		log.Fatalf("Error checking collection: %v", err)
+		return err
+	}
+	if live != nil {
+		schema, err := ts.collectionSchema(ts.CollectionName)
+		if err != nil {
+			return err
+		}
+		if err := ts.migrateCollection(ctx, *live, schema); err != nil {
+			return fmt.Errorf("error migrating collection %s: %w", ts.CollectionName, err)
+		}
+		return nil
 	}
 
-	if !exists {
-		log.Printf("Collection %s does not exist. Creating...\n", ts.CollectionName)
-		if err := ts.createCollection(ts.CollectionName); err != nil {
-			log.Fatalf("Error creating collection: %v", err)
+	target, err := ts.getAlias(ctx, ts.CollectionName)
+	if err != nil {
+		return fmt.Errorf("error resolving alias %s: %w", ts.CollectionName, err)
+	}
+	if target != "" {
+		schema, err := ts.collectionSchema(target)
+		if err != nil {
+			return err
 		}
-		log.Printf("Collection %s created successfully\n", ts.CollectionName)
-	} else {
-		log.Printf("Collection %s already exists\n", ts.CollectionName)
+		return ts.checkOrCreateCollection(ctx, schema)
 	}
 
-	return nil
+	target, err = ts.nextCollectionVersion(ctx, ts.CollectionName)
+	if err != nil {
+		return err
+	}
+
+	// A versioned collection without alias is left over from an interrupted
+	// migration of a legacy collection
+	if version := ts.collectionVersion(target); version > 1 {
+		orphan := ts.CollectionName + "_v" + strconv.Itoa(version-1)
+		ts.logger().WarnContext(ctx, "adopting collection without alias", "collection", orphan, "alias", ts.CollectionName)
+		if err := ts.putAlias(ctx, ts.CollectionName, orphan); err != nil {
+			return err
+		}
+		schema, err := ts.collectionSchema(orphan)
+		if err != nil {
+			return err
+		}
+		return ts.checkOrCreateCollection(ctx, schema)
+	}
+
+	schema, err := ts.collectionSchema(target)
+	if err != nil {
+		return err
+	}
+	if err := ts.checkOrCreateCollection(ctx, schema); err != nil {
+		return err
+	}
+
+	return ts.putAlias(ctx, ts.CollectionName, target)
 }
 
-func (ts *TSBackend) collectionExists() (bool, error) {
-	url := fmt.Sprintf("%s/collections/%s", ts.Host, ts.CollectionName)
+// legacyCollection returns the collection named CollectionName itself, created
+// before CollectionName became an alias, or nil if there is none. Typesense
+// answers the lookup of an alias with the collection behind it.
+func (ts *TSBackend) legacyCollection(ctx context.Context) (*CollectionSchema, error) {
+	live, err := ts.getCollection(ctx, ts.CollectionName)
+	if err != nil {
+		return nil, fmt.Errorf("error checking collection %s: %w", ts.CollectionName, err)
+	}
+	if live == nil || live.Name != ts.CollectionName {
+		return nil, nil
+	}
+	return live, nil
+}
 
-	resp, body, err := ts.makehttpRequest(url, http.MethodGet, nil)
+// checkOrCreateCollection creates a collection if it doesn't exist and
+// migrates it to the schema otherwise
+func (ts *TSBackend) checkOrCreateCollection(ctx context.Context, schema CollectionSchema) error {
+	live, err := ts.getCollection(ctx, schema.Name)
 	if err != nil {
-		return false, err
+		return fmt.Errorf("error checking collection %s: %w", schema.Name, err)
 	}
-	// 404 means collection doesn't exist
-	if resp.StatusCode == http.StatusNotFound {
-		return false, nil
+
+	if live == nil {
+		err := ts.createCollection(ctx, schema)
+		if err == nil {
+			ts.logger().InfoContext(ctx, "created collection", "collection", schema.Name)
+			return nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return fmt.Errorf("error creating collection %s: %w", schema.Name, err)
+		}
+
+		// Another instance created the collection in the meantime, it is
+		// migrated like any existing collection
+		var lookupErr error
+		live, lookupErr = ts.getCollection(ctx, schema.Name)
+		if lookupErr != nil {
+			return fmt.Errorf("error checking collection %s: %w", schema.Name, lookupErr)
+		}
+		if live == nil {
+			return fmt.Errorf("error creating collection %s: %w", schema.Name, err)
+		}
 	}
 
-	// Any status code other than 200 is an error
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("unexpected status code: %d, body: %s", resp.StatusCode, string(body))
+	ts.logger().DebugContext(ctx, "collection exists", "collection", schema.Name, "schema_version", live.Version())
+	if err := ts.migrateCollection(ctx, *live, schema); err != nil {
+		return fmt.Errorf("error migrating collection %s: %w", schema.Name, err)
 	}
 
-	return true, nil
+	return nil
 }
 
-// create a typesense collection
-func (ts *TSBackend) createCollection(name string) error {
-	schema := CollectionSchema{
-		Name: name,
-		Fields: []Field{
-			// Base information
-			{Name: "id", Type: "string"},
-			{Name: "d", Type: "string"},
-			{Name: "type", Type: "string[]"},
-			{Name: "name", Type: "string"},
-			{Name: "description", Type: "string", Optional: true},
-			{Name: "about", Type: "object[]", Optional: true},
-			{Name: "keywords", Type: "string[]", Optional: true},
-			{Name: "inLanguage", Type: "string[]", Optional: true},
-			{Name: "image", Type: "string", Optional: true},
-			{Name: "trailer", Type: "object[]", Optional: true},
-
-			// Provenience
-			{Name: "creator", Type: "object[]", Optional: true},
-			{Name: "contributor", Type: "object[]", Optional: true},
-			{Name: "dateCreated", Type: "string", Optional: true},
-			{Name: "datePublished", Type: "string", Optional: true},
-			{Name: "dateModified", Type: "string", Optional: true},
-			{Name: "publisher", Type: "object[]", Optional: true},
-			{Name: "funder", Type: "object[]", Optional: true},
-
-			// Costs and Rights
-			{Name: "isAccessibleForFree", Type: "bool", Optional: true},
-			{Name: "license", Type: "object", Optional: true},
-			{Name: "conditionsOfAccess", Type: "object", Optional: true},
-
-			// Educational Metadata
-			{Name: "learningResourceType", Type: "object[]", Optional: true},
-			{Name: "audience", Type: "object[]", Optional: true},
-			{Name: "teaches", Type: "object[]", Optional: true},
-			{Name: "assesses", Type: "object[]", Optional: true},
-			{Name: "competencyRequired", Type: "object[]", Optional: true},
-			{Name: "educationalLevel", Type: "object[]", Optional: true},
-			{Name: "interactivityType", Type: "object", Optional: true},
-
-			// Relation
-			{Name: "isBasedOn", Type: "object[]", Optional: true},
-			{Name: "isPartOf", Type: "object[]", Optional: true},
-			{Name: "hasPart", Type: "object[]", Optional: true},
-
-			// Technical
-			{Name: "duration", Type: "string", Optional: true},
-
-			// Nostr Event
-			{Name: "eventID", Type: "string"},
-			{Name: "eventKind", Type: "int32"},
-			{Name: "eventPubKey", Type: "string"},
-			{Name: "eventSignature", Type: "string"},
-			{Name: "eventCreatedAt", Type: "int64"},
-			{Name: "eventContent", Type: "string"},
-			{Name: "eventRaw", Type: "string"},
-		},
+// collectionSchema returns the schema of the AMB collection with the
+// customizations of the deployment applied
+func (ts *TSBackend) collectionSchema(name string) (CollectionSchema, error) {
+	schema := ambCollectionSchema(name)
+	if err := ts.Schema.apply(&schema); err != nil {
+		return schema, fmt.Errorf("invalid schema options: %w", err)
+	}
+	return schema, nil
+}
+
+// ambCollectionSchema returns the built-in schema of the collection holding the AMB documents
+func ambCollectionSchema(name string) CollectionSchema {
+	return CollectionSchema{
+		Name:                name,
+		Fields:              slices.Clone(ambSchemaFields),
 		DefaultSortingField: "eventCreatedAt",
 		EnableNestedFields:  true,
+		Metadata:            schemaVersionMetadata(ambSchemaVersion),
 	}
+}
 
-	url := fmt.Sprintf("%s/collections", ts.Host)
+// create a typesense collection
+func (ts *TSBackend) createCollection(ctx context.Context, schema CollectionSchema) error {
+	path := "/collections"
 
 	jsonData, err := json.Marshal(schema)
 	if err != nil {
 		return err
 	}
 
-	resp, body, err := ts.makehttpRequest(url, http.MethodPost, jsonData)
+	resp, body, err := ts.makehttpRequest(ctx, opCollection, path, http.MethodPost, jsonData)
+	if err != nil {
+		return err
+	}
+
+	// Typesense answers 409 if the collection was created in the meantime
+	// and 400 if it refuses the schema
+	if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusBadRequest {
+		return fmt.Errorf("%w: %w", ErrSchemaConflict, newTypesenseError(resp, body))
+	}
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to create collection, status: %d, body: %s", resp.StatusCode, string(body))
+		return fmt.Errorf("failed to create collection: %w", newTypesenseError(resp, body))
 	}
 
 	return nil
 }
 
-func (ts *TSBackend) makehttpRequest(url string, method string, jsonData []byte) (*http.Response, []byte, error) {
-    // Create request
-    req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
-    if err != nil {
-        return nil, nil, err
-    }
-    
-    req.Header.Set("X-TYPESENSE-API-KEY", ts.ApiKey)
-    req.Header.Set("Content-Type", "application/json")
-    
-    // Execute request
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        return nil, nil, err
-    }
-    defer resp.Body.Close()
-    
-    // Read body
-    body, err := io.ReadAll(resp.Body)
-    if err != nil {
-        return resp, nil, err
-    }
-    
-    return resp, body, nil
-}
-
-// TODO Count events
-func CountEvents(filter nostr.Filter) (int64, error) {
-	fmt.Println("filter", filter)
-	// search by author
-	// search by d-tag
-	return 0, nil
+// documentsPath builds the path of the collection's documents endpoint, or of a
+// path below it, with all parameters URL-encoded
+func (ts *TSBackend) documentsPath(path string, params url.Values) string {
+	return ts.collectionDocumentsPath(ts.CollectionName, path, params)
+}
+
+// collectionDocumentsPath is like documentsPath for any collection
+func (ts *TSBackend) collectionDocumentsPath(collection string, path string, params url.Values) string {
+	p := fmt.Sprintf("/collections/%s/documents%s", url.PathEscape(collection), path)
+	if len(params) > 0 {
+		p += "?" + params.Encode()
+	}
+	return p
+}
+
+// operation names the kind of a Typesense request and decides on its timeout
+type operation string
+
+const (
+	opSearch     operation = "search"
+	opGet        operation = "get"
+	opExport     operation = "export"
+	opCreate     operation = "create"
+	opUpsert     operation = "upsert"
+	opDelete     operation = "delete"
+	opCollection operation = "collection"
+	// opReindex exports a whole collection during Reindex
+	opReindex operation = "reindex"
+)
+
+const (
+	defaultSearchTimeout = 10 * time.Second
+	defaultWriteTimeout  = 10 * time.Second
+	defaultAdminTimeout  = 30 * time.Second
+	// defaultReindexTimeout is generous, since exporting a large collection
+	// takes as long as the connection allows
+	defaultReindexTimeout = 30 * time.Minute
+)
+
+// defaultHTTPClient is shared by all backends without an own HTTPClient, so
+// connections to Typesense are pooled and reused across requests
+var defaultHTTPClient = newDefaultHTTPClient()
+
+func newDefaultHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 100
+	transport.MaxIdleConnsPerHost = 32
+	return &http.Client{Transport: transport}
+}
+
+func (ts *TSBackend) httpClient() *http.Client {
+	if ts.HTTPClient != nil {
+		return ts.HTTPClient
+	}
+	return defaultHTTPClient
 }
 
+// timeout returns how long a request of the given operation may take
+func (ts *TSBackend) timeout(op operation) time.Duration {
+	timeout, fallback := ts.WriteTimeout, defaultWriteTimeout
+	switch op {
+	case opSearch, opGet:
+		timeout, fallback = ts.SearchTimeout, defaultSearchTimeout
+	case opExport, opCollection:
+		timeout, fallback = ts.AdminTimeout, defaultAdminTimeout
+	case opReindex:
+		timeout, fallback = ts.ReindexTimeout, defaultReindexTimeout
+	}
+
+	if timeout <= 0 {
+		return fallback
+	}
+	return timeout
+}
+
+// makehttpRequest sends a request for the path to a Typesense node, retrying
+// temporary failures on the next healthy node as configured by the retry policy
+// and failing fast while the circuit breaker is open
+func (ts *TSBackend) makehttpRequest(ctx context.Context, op operation, path string, method string, jsonData []byte) (*http.Response, []byte, error) {
+	return ts.request(ctx, op, path, method, jsonData, false)
+}
+
+// streamRequest is makehttpRequest for large responses. The body of a 200
+// response is left unread for the caller to stream and close, the timeout of
+// the operation covers reading it. Other responses are read like before.
+func (ts *TSBackend) streamRequest(ctx context.Context, op operation, path string, method string) (*http.Response, []byte, error) {
+	return ts.request(ctx, op, path, method, nil, true)
+}
+
+func (ts *TSBackend) request(ctx context.Context, op operation, path string, method string, jsonData []byte, stream bool) (*http.Response, []byte, error) {
+	policy := ts.Retry.withDefaults()
+	attempts := 1
+	if retryable(op, method) {
+		attempts = policy.MaxAttempts
+	}
+
+	// A trial request of the circuit breaker that ends without an outcome,
+	// e.g. cancelled by the caller, must not keep the circuit blocked
+	trial := false
+	defer func() {
+		if trial {
+			ts.breaker.release(ts.CircuitBreaker)
+		}
+	}()
+
+	for attempt := 1; ; attempt++ {
+		allowed, isTrial := ts.breaker.allow(ts.CircuitBreaker)
+		if !allowed {
+			return nil, nil, ErrCircuitOpen
+		}
+		trial = isTrial
+
+		node := ts.nextNode()
+		attemptCtx, span := ts.startSpan(ctx, "typesense."+string(op),
+			attrOperation.String(string(op)),
+			attrHTTPMethod.String(method),
+			attrServer.String(node),
+			attrAttempt.Int(attempt))
+		start := time.Now()
+		resp, body, err := ts.sendRequest(attemptCtx, op, node+path, method, jsonData, stream)
+		ts.recordRequest(attemptCtx, op, method, node, attempt, time.Since(start), resp, err)
+		endRequestSpan(span, resp, err)
+
+		// Requests cancelled by the caller say nothing about the health of Typesense
+		if ctx.Err() != nil {
+			return resp, body, err
+		}
+
+		failed := temporaryFailure(resp, err)
+		ts.breaker.record(ts.CircuitBreaker, failed)
+		trial = false
+		ts.nodes.record(node, nodeFailure(resp, err), ts.NodeCooldown)
+		if !failed {
+			return resp, body, err
+		}
 
+		// A request that never reached the node can be sent to another one
+		if attempt >= attempts && !(notSent(err) && attempt < ts.nodeCount()) {
+			if err != nil {
+				err = fmt.Errorf("%w: %w", ErrUnreachable, err)
+				ts.logger().ErrorContext(ctx, "typesense request failed", "operation", op, "method", method, "attempts", attempt, "error", err)
+				return resp, body, err
+			}
+			ts.logger().ErrorContext(ctx, "typesense request failed", "operation", op, "method", method, "attempts", attempt, "status", resp.StatusCode)
+			return resp, body, err
+		}
+
+		if err := sleep(ctx, policy.backoff(attempt, resp)); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// recordRequest logs and counts a single request to Typesense. The request path
+// is left out since it carries search terms and document ids.
+func (ts *TSBackend) recordRequest(ctx context.Context, op operation, method string, node string, attempt int, latency time.Duration, resp *http.Response, err error) {
+	attrs := []any{
+		slog.String("operation", string(op)),
+		slog.String("method", method),
+		slog.String("node", node),
+		slog.Int("attempt", attempt),
+		slog.Duration("latency", latency),
+	}
+
+	if err != nil {
+		ts.metrics().CountResponse(string(op), 0)
+		ts.logger().WarnContext(ctx, "typesense request error", append(attrs, slog.Any("error", err))...)
+		return
+	}
+	ts.metrics().CountResponse(string(op), resp.StatusCode)
+
+	level := slog.LevelDebug
+	if temporaryFailure(resp, nil) {
+		level = slog.LevelWarn
+	}
+	ts.logger().Log(ctx, level, "typesense request", append(attrs, slog.Int("status", resp.StatusCode))...)
+}
+
+// endRequestSpan ends the span of a request, failed if Typesense couldn't be
+// reached or responded with a server error
+func endRequestSpan(span trace.Span, resp *http.Response, err error) {
+	if resp != nil {
+		span.SetAttributes(attrHTTPStatus.Int(resp.StatusCode))
+		if err == nil && resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	endSpan(span, err)
+}
+
+// sendRequest sends a single request to Typesense and reads the response body.
+// If stream is set, the body of a 200 response is returned unread instead.
+func (ts *TSBackend) sendRequest(ctx context.Context, op operation, url string, method string, jsonData []byte, stream bool) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ts.timeout(op))
+
+	// Create request
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(jsonData))
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	req.Header.Set("X-TYPESENSE-API-KEY", ts.ApiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	// Execute request
+	resp, err := ts.httpClient().Do(req)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	if stream && resp.StatusCode == http.StatusOK {
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil, nil
+	}
+	defer cancel()
+	defer resp.Body.Close()
+
+	// Read body, still bound to the request's timeout
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+
+	return resp, body, nil
+}
+
+// cancelOnClose releases the timeout of a streamed response once it was read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
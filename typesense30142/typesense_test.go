@@ -0,0 +1,507 @@
+package typesense30142
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTypesense is a minimal in-memory stand-in for the Typesense document,
+// collection and alias API
+type fakeTypesense struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// collections maps collection names to their documents by document id
+	collections map[string]map[string]json.RawMessage
+	// aliases maps alias names to collection names
+	aliases map[string]string
+	// deleteFilters records the filter_by of every delete by query
+	deleteFilters []string
+	// numDeleted, if set, is reported as the result of every delete by query
+	// instead of the number of matching documents
+	numDeleted int
+}
+
+func newFakeTypesense(t *testing.T) *fakeTypesense {
+	fake := &fakeTypesense{collections: map[string]map[string]json.RawMessage{}, aliases: map[string]string{}}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeTypesense) backend() *TSBackend {
+	return &TSBackend{Host: f.URL, CollectionName: "amb"}
+}
+
+// collection returns the documents of a collection or of the collection an alias points to
+func (f *fakeTypesense) collection(name string) map[string]json.RawMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.documents(name)
+}
+
+// documents returns the documents of a collection, creating it if necessary.
+// Like in Typesense, a collection takes precedence over an alias of the same
+// name. f.mu must be held.
+func (f *fakeTypesense) documents(name string) map[string]json.RawMessage {
+	if target, ok := f.aliases[name]; ok && f.collections[name] == nil {
+		name = target
+	}
+	if f.collections[name] == nil {
+		f.collections[name] = map[string]json.RawMessage{}
+	}
+	return f.collections[name]
+}
+
+// document decodes an AMB document of the "amb" collection
+func (f *fakeTypesense) document(id string) AMBMetadata {
+	var doc AMBMetadata
+	json.Unmarshal(f.collection("amb")[id], &doc)
+	return doc
+}
+
+// legacyDocument encodes an event like releases before address-derived
+// document ids did, under its event id
+func legacyDocument(event *nostr.Event) json.RawMessage {
+	doc, _ := eventToDocument(event)
+	doc.ID = event.ID
+	raw, _ := json.Marshal(doc)
+	return raw
+}
+
+func (f *fakeTypesense) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "aliases":
+		f.handleAlias(w, r, parts[1])
+	case len(parts) <= 2 && parts[0] == "collections":
+		f.handleCollection(w, r, parts[1:])
+	case len(parts) >= 3 && parts[0] == "collections" && parts[2] == "documents":
+		id := ""
+		if len(parts) > 3 {
+			id = parts[3]
+		}
+		f.handleDocuments(w, r, f.documents(parts[1]), id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleAlias serves /aliases/{name}
+func (f *fakeTypesense) handleAlias(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method == http.MethodPut {
+		var alias struct {
+			CollectionName string `json:"collection_name"`
+		}
+		json.NewDecoder(r.Body).Decode(&alias)
+		f.aliases[name] = alias.CollectionName
+	}
+
+	target, ok := f.aliases[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "Not Found"}`))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"name": name, "collection_name": target})
+}
+
+// handleCollection serves /collections and /collections/{name}
+func (f *fakeTypesense) handleCollection(w http.ResponseWriter, r *http.Request, path []string) {
+	switch {
+	case r.Method == http.MethodPost && len(path) == 0:
+		var schema CollectionSchema
+		json.NewDecoder(r.Body).Decode(&schema)
+		if _, exists := f.collections[schema.Name]; exists {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"message": "A collection with name ` + schema.Name + ` already exists."}`))
+			return
+		}
+		f.collections[schema.Name] = map[string]json.RawMessage{}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(schema)
+
+	case r.Method == http.MethodGet && len(path) == 1:
+		if _, exists := f.collections[path[0]]; !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(ambCollectionSchema(path[0]))
+
+	case r.Method == http.MethodDelete && len(path) == 1:
+		if _, exists := f.collections[path[0]]; !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+			return
+		}
+		delete(f.collections, path[0])
+		json.NewEncoder(w).Encode(map[string]string{"name": path[0]})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDocuments serves /collections/{name}/documents[/{id}]
+func (f *fakeTypesense) handleDocuments(w http.ResponseWriter, r *http.Request, documents map[string]json.RawMessage, id string) {
+	switch {
+	case r.Method == http.MethodPost && id == "":
+		body, _ := io.ReadAll(r.Body)
+		var doc struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, exists := documents[doc.ID]; exists && r.URL.Query().Get("action") != "upsert" {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"message": "A document with id ` + doc.ID + ` already exists."}`))
+			return
+		}
+		documents[doc.ID] = body
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+
+	case r.Method == http.MethodPost && id == "import":
+		body, _ := io.ReadAll(r.Body)
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			var doc struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal([]byte(line), &doc); err != nil {
+				w.Write([]byte(`{"success": false, "error": "Bad JSON."}` + "\n"))
+				continue
+			}
+			documents[doc.ID] = json.RawMessage(line)
+			w.Write([]byte(`{"success": true}` + "\n"))
+		}
+
+	case r.Method == http.MethodGet && id == "export":
+		for _, doc := range documents {
+			w.Write(doc)
+			w.Write([]byte("\n"))
+		}
+
+	case r.Method == http.MethodGet && id != "":
+		doc, exists := documents[id]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Could not find a document with id: ` + id + `"}`))
+			return
+		}
+		w.Write(doc)
+
+	case r.Method == http.MethodDelete && id != "":
+		doc, exists := documents[id]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Could not find a document with id: ` + id + `"}`))
+			return
+		}
+		delete(documents, id)
+		w.Write(doc)
+
+	case r.Method == http.MethodDelete && id == "":
+		filterBy := r.URL.Query().Get("filter_by")
+		f.deleteFilters = append(f.deleteFilters, filterBy)
+
+		deleted := 0
+		for docID, doc := range documents {
+			if matchesFakeFilter(doc, filterBy) {
+				delete(documents, docID)
+				deleted++
+			}
+		}
+		if f.numDeleted != 0 {
+			deleted = f.numDeleted
+		}
+		json.NewEncoder(w).Encode(map[string]int{"num_deleted": deleted})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// fakeFilterClause matches a single clause of a filter_by expression
+var fakeFilterClause = regexp.MustCompile(`^([A-Za-z0-9_.]+):(=|!=|<=|>=)(.*)$`)
+
+// matchesFakeFilter evaluates the subset of filter_by used for deletes: clauses
+// joined by && that compare a field by := or :!= with a value or a list of values, or
+// numerically by :<= and :>=. Filters using anything else match no document.
+func matchesFakeFilter(doc json.RawMessage, filterBy string) bool {
+	var fields map[string]any
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return false
+	}
+
+	for _, clause := range splitFakeFilter(filterBy, " && ") {
+		match := fakeFilterClause.FindStringSubmatch(clause)
+		if match == nil {
+			return false
+		}
+		field, op, value := match[1], match[2], match[3]
+
+		if op == "<=" || op == ">=" {
+			limit, err := strconv.ParseFloat(value, 64)
+			number, ok := fields[field].(float64)
+			if err != nil || !ok || op == "<=" && number > limit || op == ">=" && number < limit {
+				return false
+			}
+			continue
+		}
+
+		values := []string{value}
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			values = splitFakeFilter(value[1:len(value)-1], ",")
+		}
+		matched := slices.ContainsFunc(values, func(value string) bool {
+			return fakeFieldEquals(fields[field], value)
+		})
+		if matched != (op == "=") {
+			return false
+		}
+	}
+	return true
+}
+
+// fakeFilterUnquote reverses the escaping of QuoteFilterValue
+var fakeFilterUnquote = strings.NewReplacer(`\\`, `\`, "\\`", "`")
+
+// fakeFieldEquals compares a document field, or any element of an array field,
+// with a backtick quoted string or a number
+func fakeFieldEquals(field any, value string) bool {
+	if elements, ok := field.([]any); ok {
+		return slices.ContainsFunc(elements, func(element any) bool { return fakeFieldEquals(element, value) })
+	}
+	if quoted, ok := strings.CutPrefix(value, "`"); ok {
+		return field == fakeFilterUnquote.Replace(strings.TrimSuffix(quoted, "`"))
+	}
+	return fmt.Sprint(field) == value
+}
+
+// splitFakeFilter splits at the separator outside of backtick quoted values
+func splitFakeFilter(expression string, separator string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(expression); i++ {
+		switch {
+		case expression[i] == '\\' && quoted:
+			i++
+		case expression[i] == '`':
+			quoted = !quoted
+		case !quoted && strings.HasPrefix(expression[i:], separator):
+			parts = append(parts, expression[start:i])
+			start = i + len(separator)
+			i += len(separator) - 1
+		}
+	}
+	return append(parts, expression[start:])
+}
+
+// countingTransport counts the requests sent through it
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestMakehttpRequest_InjectedClient(t *testing.T) {
+	assert := assert.New(t)
+
+	fake := newFakeTypesense(t)
+	transport := &countingTransport{}
+	ts := fake.backend()
+	ts.HTTPClient = &http.Client{Transport: transport}
+
+	_, err := ts.getDocument(context.Background(), "unknown")
+
+	assert.NoError(err)
+	assert.Equal(1, transport.requests)
+}
+
+func TestMakehttpRequest_Timeout(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", SearchTimeout: 50 * time.Millisecond}
+
+	start := time.Now()
+	_, err := ts.QueryEvents(context.Background(), nostr.Filter{Search: "Französisch"})
+
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.Less(time.Since(start), 5*time.Second)
+}
+
+func TestMakehttpRequest_Cancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	err := ts.ReplaceEvent(ctx, createTestEvent(nostr.Tags{{"d", "resource"}}))
+
+	assert.ErrorIs(err, context.Canceled)
+}
+
+func TestTimeout_Defaults(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := &TSBackend{WriteTimeout: time.Second}
+
+	assert.Equal(defaultSearchTimeout, ts.timeout(opSearch))
+	assert.Equal(time.Second, ts.timeout(opUpsert))
+	assert.Equal(defaultAdminTimeout, ts.timeout(opCollection))
+	assert.Equal(defaultReindexTimeout, ts.timeout(opReindex))
+}
+
+// collectionServer answers collection lookups and creations with the given statuses
+func collectionServer(t *testing.T, lookupStatus int, createStatus int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.WriteHeader(lookupStatus)
+		case http.MethodPost:
+			w.WriteHeader(createStatus)
+		}
+		w.Write([]byte(`{"message": "stub"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestInit_Created(t *testing.T) {
+	assert := assert.New(t)
+
+	server := collectionServer(t, http.StatusNotFound, http.StatusCreated)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	assert.NoError(ts.Init())
+}
+
+func TestInit_Unreachable(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := &TSBackend{Host: deadNode(), CollectionName: "amb", Retry: RetryPolicy{MaxAttempts: 1}}
+
+	err := ts.Init()
+
+	assert.ErrorIs(err, ErrUnreachable)
+}
+
+func TestInit_Unauthorized(t *testing.T) {
+	assert := assert.New(t)
+
+	server := collectionServer(t, http.StatusUnauthorized, http.StatusCreated)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	err := ts.Init()
+
+	assert.ErrorIs(err, ErrUnauthorized)
+}
+
+func TestInit_UnauthorizedCreate(t *testing.T) {
+	assert := assert.New(t)
+
+	server := collectionServer(t, http.StatusNotFound, http.StatusForbidden)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	err := ts.Init()
+
+	assert.ErrorIs(err, ErrUnauthorized)
+}
+
+func TestInit_SchemaConflict(t *testing.T) {
+	assert := assert.New(t)
+
+	server := collectionServer(t, http.StatusNotFound, http.StatusConflict)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb"}
+
+	err := ts.Init()
+
+	assert.ErrorIs(err, ErrSchemaConflict)
+}
+
+func TestInit_CreatedConcurrently(t *testing.T) {
+	assert := assert.New(t)
+
+	// Another instance creates the AMB collection right before this one
+	fake := newFakeTypesense(t)
+	fake.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/collections" {
+			body, _ := io.ReadAll(r.Body)
+			var schema CollectionSchema
+			json.Unmarshal(body, &schema)
+			if schema.Name == "amb_v1" {
+				fake.collection(schema.Name)
+			}
+			r.Body = io.NopCloser(strings.NewReader(string(body)))
+		}
+		fake.handle(w, r)
+	})
+	ts := fake.backend()
+
+	assert.NoError(ts.Init())
+	assert.Equal("amb_v1", fake.aliases["amb"])
+}
+
+func TestInit_UnexpectedStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	server := collectionServer(t, http.StatusInternalServerError, http.StatusCreated)
+	ts := &TSBackend{Host: server.URL, CollectionName: "amb", Retry: RetryPolicy{MaxAttempts: 1}}
+
+	err := ts.Init()
+
+	assert.Error(err)
+	assert.NotErrorIs(err, ErrUnreachable)
+}
+
+func TestCreateCollection_Unreachable(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := &TSBackend{Host: deadNode(), CollectionName: "amb", Retry: RetryPolicy{MaxAttempts: 1}}
+
+	// used to dereference the missing response
+	assert.NotPanics(func() {
+		err := ts.createCollection(context.Background(), ambCollectionSchema("amb"))
+		assert.ErrorIs(err, ErrUnreachable)
+	})
+}